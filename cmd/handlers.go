@@ -2,129 +2,334 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"github.com/nazarovlex/AVITO_TASK/internal/runner"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type AddSegmentRequest struct {
 	UserID          uuid.UUID      `json:"user_id"`
+	ExternalID      string         `json:"external_id"`
 	SegmentsToAdd   map[string]int `json:"segments_to_add"`
 	SegmentToDelete []string       `json:"segment_to_delete"`
 }
 
+// CreateUserRequest has only fields set by client, deletion is managed by the service
+type CreateUserRequest struct {
+	ID         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	ExternalID string    `json:"external_id"`
+}
+
+// CreateSegmentRequest has only fields set by client, timestamps and archivation are managed by the service
+type CreateSegmentRequest struct {
+	Slug        string   `json:"slug"`
+	Percent     int      `json:"percent"`
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	Tags        []string `json:"tags"`
+}
+
+// GetReportRequest selects report period by year and month in report time zone or by from and to,
+// other fields filter report entries
 type GetReportRequest struct {
-	Year  int `json:"year"`
-	Month int `json:"month"`
+	Year      int         `json:"year"`
+	Month     int         `json:"month"`
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Segments  []string    `json:"segments"`
+	UserIDs   []uuid.UUID `json:"user_ids"`
+	Operation string      `json:"operation"`
+	// All allows report without period over the whole history
+	All bool `json:"all"`
+}
+
+// UserResponse keeps original field names of GET /users/:id, users listing uses snake case names of db.UserWithSegments
+type UserResponse struct {
+	UserID       uuid.UUID
+	Name         string
+	ExternalID   string
+	SegmentSlugs []string
+}
+
+type UserSegmentsResponse struct {
+	UserID   uuid.UUID        `json:"user_id"`
+	At       time.Time        `json:"at"`
+	Segments []db.UserSegment `json:"segments"`
+}
+
+type RunnerLeaderResponse struct {
+	InstanceID string `json:"instance_id"`
+	Leader     string `json:"leader"`
+	IsLeader   bool   `json:"is_leader"`
 }
 
-func getUsers(ctx context.Context, database *db.Service) httprouter.Handle {
-	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-		users, err := database.FetchUsers(ctx)
+// parseUserID reads user id from route or request value, with ?key=external_id query the value is external id of the user.
+// On failure it writes error response and returns false.
+func parseUserID(database *db.Service, w http.ResponseWriter, r *http.Request, value string) (uuid.UUID, bool) {
+	switch key := r.URL.Query().Get("key"); key {
+	case "", "id":
+		userId, err := uuid.Parse(value)
+		if err != nil {
+			writeInvalidID(w, r, err)
+			return uuid.Nil, false
+		}
+		return userId, true
+	case "external_id":
+		user, err := database.FetchUserByExternalID(r.Context(), value)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("fetch users error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Users fetching error", err)
+			return uuid.Nil, false
+		}
+		return user.ID, true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidID, fmt.Sprintf("Unknown user key %q", key), db.FieldError{
+			Field:   "key",
+			Value:   key,
+			Message: "must be id or external_id",
+		})
+		return uuid.Nil, false
+	}
+}
+
+// queryInt parses optional integer query parameter, parse failures are appended to fieldErrors
+func queryInt(query url.Values, name string, fieldErrors *[]db.FieldError) int {
+	value := query.Get(name)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		*fieldErrors = append(*fieldErrors, db.FieldError{Field: name, Value: value, Message: "must be integer"})
+	}
+	return parsed
+}
+
+// queryBool parses optional boolean query parameter, parse failures are appended to fieldErrors
+func queryBool(query url.Values, name string, fieldErrors *[]db.FieldError) bool {
+	value := query.Get(name)
+	if value == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		*fieldErrors = append(*fieldErrors, db.FieldError{Field: name, Value: value, Message: "must be boolean"})
+	}
+	return parsed
+}
+
+// queryTime parses optional RFC 3339 timestamp query parameter, parse failures are appended to fieldErrors
+func queryTime(query url.Values, name string, fieldErrors *[]db.FieldError) time.Time {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		*fieldErrors = append(*fieldErrors, db.FieldError{Field: name, Value: value, Message: "must be RFC 3339 timestamp"})
+	}
+	return parsed
+}
+
+func getUsers(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		query := r.URL.Query()
+		var fieldErrors []db.FieldError
+		filter := db.UsersFilter{
+			Sort:        query.Get("sort"),
+			SegmentSlug: query.Get("segment"),
+			NamePrefix:  query.Get("name_prefix"),
+			Limit:       queryInt(query, "limit", &fieldErrors),
+			NoSegments:  queryBool(query, "no_segments", &fieldErrors),
+		}
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+
+		users, err := database.FetchUsers(ctx, filter, query.Get("cursor"))
+		if err != nil {
+			writeError(w, r, "Fetch users error", err)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		err = json.NewEncoder(w).Encode(users)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Json encode error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Json encode error", err)
 		}
 	}
 }
 
-func getUser(ctx context.Context, database *db.Service) httprouter.Handle {
-	return func(w http.ResponseWriter, _ *http.Request, routerParams httprouter.Params) {
-		userId, err := uuid.Parse(routerParams.ByName("id"))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("UUID parse error: %v", err), http.StatusInternalServerError)
+func getUser(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		userId, ok := parseUserID(database, w, r, routerParams.ByName("id"))
+		if !ok {
 			return
 		}
 		user, err := database.FetchUser(ctx, userId)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Users not found: %v", err), http.StatusNotFound)
+			writeError(w, r, "Users fetching error", err)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(user)
+		err = json.NewEncoder(w).Encode(UserResponse{
+			UserID:       user.UserID,
+			Name:         user.Name,
+			ExternalID:   user.ExternalID,
+			SegmentSlugs: user.SegmentSlugs,
+		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Json encode error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Json encode error", err)
 		}
 	}
 }
 
-func createUser(ctx context.Context, database *db.Service) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		var newUser db.Users
-		err := json.NewDecoder(r.Body).Decode(&newUser)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request data: %v", err), http.StatusBadRequest)
+// getUserSegmentsAt restores segments which user was in at instant from at query parameter, current time by default
+func getUserSegmentsAt(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		var fieldErrors []db.FieldError
+		at := queryTime(r.URL.Query(), "at", &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+		if at.IsZero() {
+			at = time.Now()
+		}
+		userId, ok := parseUserID(database, w, r, routerParams.ByName("id"))
+		if !ok {
 			return
 		}
 
-		err = database.CreateUser(ctx, newUser.Name)
+		segments, err := database.FetchUserSegmentsAt(ctx, userId, at)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Users creating error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "User segments fetching error", err)
 			return
 		}
 
-		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(UserSegmentsResponse{UserID: userId, At: at, Segments: segments})
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
 	}
 }
 
-func deleteUser(ctx context.Context, database *db.Service) httprouter.Handle {
+// getUserHistory returns page of user segments additions and removals sorted by operation time,
+// events are filtered by from and to operation time and by repeated segment parameter
+func getUserHistory(database *db.Service) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
-		userId, err := uuid.Parse(routerParams.ByName("id"))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("UUID parse error: %v", err), http.StatusInternalServerError)
+		ctx := r.Context()
+		query := r.URL.Query()
+		var fieldErrors []db.FieldError
+		filter := db.UserHistoryFilter{
+			Limit:        queryInt(query, "limit", &fieldErrors),
+			From:         queryTime(query, "from", &fieldErrors),
+			To:           queryTime(query, "to", &fieldErrors),
+			SegmentSlugs: query["segment"],
+		}
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+		userId, ok := parseUserID(database, w, r, routerParams.ByName("id"))
+		if !ok {
 			return
 		}
 
-		err = database.DeleteUser(ctx, userId)
+		history, err := database.FetchUserHistory(ctx, userId, filter, query.Get("cursor"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Users deleting error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "User history fetching error", err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(history)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
 	}
 }
 
-func createSegment(ctx context.Context, database *db.Service) httprouter.Handle {
+func createUser(database *db.Service) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		var newSegment db.Segments
-		err := json.NewDecoder(r.Body).Decode(&newSegment)
+		ctx := r.Context()
+		var requestData CreateUserRequest
+		err := json.NewDecoder(r.Body).Decode(&requestData)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request data: %v", err), http.StatusBadRequest)
+			writeInvalidJSON(w, r, err)
 			return
 		}
 
-		err = database.CreateSegment(ctx, newSegment.Slug)
+		user, err := database.CreateUser(ctx, db.Users{
+			ID:         requestData.ID,
+			Name:       requestData.Name,
+			ExternalID: requestData.ExternalID,
+		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Segment creating error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Users creating error", err)
 			return
 		}
 
+		w.Header().Set("Location", "/users/"+user.ID.String())
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(user)
+		if err != nil {
+			log.Printf("Json encode error: %v\n", err)
+		}
 	}
 }
 
-func deleteSegment(ctx context.Context, database *db.Service) httprouter.Handle {
-	return func(w http.ResponseWriter, _ *http.Request, routerParams httprouter.Params) {
-		slug := routerParams.ByName("slug")
+// deleteUser marks user deleted keeping its history, with erase=true it deletes personal data and anonymizes history
+func deleteUser(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		var fieldErrors []db.FieldError
+		erase := queryBool(r.URL.Query(), "erase", &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+		userId, ok := parseUserID(database, w, r, routerParams.ByName("id"))
+		if !ok {
+			return
+		}
 
-		err := database.DeleteSegment(ctx, slug)
+		if erase {
+			err := database.EraseUser(ctx, userId)
+			if err != nil {
+				writeError(w, r, "Users erasing error", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		err := database.DeleteUser(ctx, userId)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Deleting slug error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Users deleting error", err)
 			return
 		}
 
@@ -132,168 +337,549 @@ func deleteSegment(ctx context.Context, database *db.Service) httprouter.Handle
 	}
 }
 
-func updateSegment(ctx context.Context, database *db.Service) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
-		var updatedSegment db.Segments
-		err := json.NewDecoder(r.Body).Decode(&updatedSegment)
+func createSegment(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		var requestData CreateSegmentRequest
+		err := json.NewDecoder(r.Body).Decode(&requestData)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request data: %v", err), http.StatusBadRequest)
+			writeInvalidJSON(w, r, err)
 			return
 		}
 
-		err = database.UpdateSegment(ctx, updatedSegment)
+		segment, err := database.CreateSegment(ctx, db.Segments{
+			Slug:        requestData.Slug,
+			Percent:     requestData.Percent,
+			Description: requestData.Description,
+			Owner:       requestData.Owner,
+			Tags:        requestData.Tags,
+		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Slug updating error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "Segment creating error", err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Location", "/segments/"+url.PathEscape(segment.Slug))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(segment)
+		if err != nil {
+			log.Printf("Json encode error: %v\n", err)
+		}
 	}
 }
 
-func addSegmentsToUser(ctx context.Context, database *db.Service) httprouter.Handle {
+func getSegments(database *db.Service) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		var requestData AddSegmentRequest
-		err := json.NewDecoder(r.Body).Decode(&requestData)
+		ctx := r.Context()
+		query := r.URL.Query()
+		var fieldErrors []db.FieldError
+		filter := db.SegmentsFilter{
+			Search:   query.Get("search"),
+			Owner:    query.Get("owner"),
+			Tag:      query.Get("tag"),
+			Limit:    queryInt(query, "limit", &fieldErrors),
+			Archived: queryBool(query, "archived", &fieldErrors),
+		}
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+
+		segments, err := database.FetchSegments(ctx, filter, query.Get("cursor"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request data: %v", err), http.StatusBadRequest)
+			writeError(w, r, "Fetch segments error", err)
 			return
 		}
 
-		// check userId
-		userExist := database.CheckExistedUser(ctx, requestData.UserID)
-		if userExist == false {
-			http.Error(w, fmt.Sprintf("Users not found: %v", err), http.StatusNotFound)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(segments)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
+
+func getSegment(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		segment, err := database.FetchSegmentDetails(ctx, routerParams.ByName("slug"))
+		if err != nil {
+			writeError(w, r, "Segment fetching error", err)
 			return
 		}
 
-		currentTime := time.Now()
-		var currentSegment db.Segments
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(segment)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
 
-		// delete segments
-		for _, segment := range requestData.SegmentToDelete {
-			currentSegment, err = database.FetchSegment(ctx, segment)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Slug not found - %v error: %v", segment, err), http.StatusBadRequest)
-				return
+// getSegmentMembers returns page of segment members, with ?format=csv or ?format=ndjson it streams all members
+func getSegmentMembers(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		slug := routerParams.ByName("slug")
+		query := r.URL.Query()
+		switch format := query.Get("format"); format {
+		case "", "json":
+		case "csv", "ndjson":
+			streamSegmentMembers(database, w, r, slug, format)
+			return
+		default:
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", db.FieldError{
+				Field:   "format",
+				Value:   format,
+				Message: "must be json, csv or ndjson",
+			})
+			return
+		}
+
+		var fieldErrors []db.FieldError
+		limit := queryInt(query, "limit", &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+		members, err := database.FetchSegmentMembers(ctx, slug, limit, query.Get("cursor"))
+		if err != nil {
+			writeError(w, r, "Segment members fetching error", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(members)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
+
+// streamSegmentMembers writes all segment members as CSV or NDJSON, each page is flushed to the client as soon as it is read
+func streamSegmentMembers(database *db.Service, w http.ResponseWriter, r *http.Request, slug, format string) {
+	ctx := r.Context()
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	jsonEncoder := json.NewEncoder(w)
+
+	// headers are sent with the first page, so unknown segment still gets problem response
+	started := false
+	start := func() error {
+		if started {
+			return nil
+		}
+		started = true
+		if format == "ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			return nil
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_members.csv", url.PathEscape(slug)))
+		return csvWriter.Write([]string{"user_id", "name", "external_id", "expires_at"})
+	}
+
+	err := database.StreamSegmentMembers(ctx, slug, func(members []db.SegmentMember) error {
+		err := start()
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if format == "ndjson" {
+				err = jsonEncoder.Encode(member)
+			} else {
+				expiresAt := ""
+				if member.ExpiresAt != nil {
+					expiresAt = member.ExpiresAt.Format(time.RFC3339)
+				}
+				err = csvWriter.Write([]string{member.UserID.String(), member.Name, member.ExternalID, expiresAt})
 			}
-			err = database.DeleteUserSegments(ctx, requestData.UserID, currentSegment.ID)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("DB query error: %v", err), http.StatusInternalServerError)
-				return
+				return err
 			}
+		}
+		csvWriter.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return csvWriter.Error()
+	})
+	if err == nil {
+		// empty segment still gets csv header
+		err = start()
+		csvWriter.Flush()
+	}
+	if err != nil && !started {
+		writeError(w, r, "Segment members fetching error", err)
+	} else if err != nil {
+		// response is already partially sent, abort it so the client doesn't take truncated body for complete one
+		log.Printf("Request %s segment members streaming error: %v\n", requestID(ctx), err)
+		panic(http.ErrAbortHandler)
+	}
+}
 
-			operation := "удаление"
-			err = database.SaveHistory(ctx, requestData.UserID, currentSegment.ID, operation, time.Now())
-			if err != nil {
-				http.Error(w, fmt.Sprintf("History saving error: %v", err), http.StatusInternalServerError)
-				return
-			}
+// deleteSegment archives segment, with purge=true it permanently deletes already archived segment
+func deleteSegment(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		slug := routerParams.ByName("slug")
+		var fieldErrors []db.FieldError
+		purge := queryBool(r.URL.Query(), "purge", &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
 		}
 
-		// add new segments and expiration time to user
-		for segment, ttl := range requestData.SegmentsToAdd {
-			currentSegment, err = database.FetchSegment(ctx, segment)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Slug not found - %v error: %v", segment, err), http.StatusBadRequest)
-				return
-			}
-			err = database.AddUserSegments(ctx, requestData.UserID, currentSegment.ID, currentTime.Add(time.Duration(ttl)*time.Hour))
-			pgErr, ok := err.(pg.Error)
-			if ok && pgErr.IntegrityViolation() {
-				http.Error(w, fmt.Sprintf("Some segment already added to user: %v", err), http.StatusInternalServerError)
-				return
-			} else if err != nil {
-				http.Error(w, fmt.Sprintf("DB query error: %v", err), http.StatusInternalServerError)
-				return
-			}
-			operation := "добавление"
-			err = database.SaveHistory(ctx, requestData.UserID, currentSegment.ID, operation, currentTime)
+		if purge {
+			err := database.PurgeSegment(ctx, slug)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("History saving error: %v", err), http.StatusInternalServerError)
+				writeError(w, r, "Purging slug error", err)
 				return
 			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		segment, err := database.ArchiveSegment(ctx, slug)
+		if err != nil {
+			writeError(w, r, "Deleting slug error", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(segment)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
 		}
 	}
 }
 
-func createReport(ctx context.Context, database *db.Service) httprouter.Handle {
+func restoreSegment(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		segment, err := database.RestoreSegment(ctx, routerParams.ByName("slug"))
+		if err != nil {
+			writeError(w, r, "Restoring slug error", err)
+			return
+		}
+
+		w.Header().Set("Location", "/segments/"+url.PathEscape(segment.Slug))
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(segment)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
+
+func updateSegment(database *db.Service) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx := r.Context()
+		var updatedSegment db.Segments
+		err := json.NewDecoder(r.Body).Decode(&updatedSegment)
+		if err != nil {
+			writeInvalidJSON(w, r, err)
+			return
+		}
+
+		segment, err := database.UpdateSegment(ctx, routerParams.ByName("slug"), updatedSegment)
+		if err != nil {
+			writeError(w, r, "Slug updating error", err)
+			return
+		}
+
+		w.Header().Set("Location", "/segments/"+url.PathEscape(segment.Slug))
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(segment)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
+
+func addSegmentsToUser(database *db.Service) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-		var requestData GetReportRequest
+		ctx := r.Context()
+		var requestData AddSegmentRequest
 		err := json.NewDecoder(r.Body).Decode(&requestData)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid request data: %v", err), http.StatusBadRequest)
+			writeInvalidJSON(w, r, err)
 			return
 		}
 
-		entries, err := database.GetHistory(ctx, requestData.Year, requestData.Month)
+		userId := requestData.UserID
+		if userId == uuid.Nil && requestData.ExternalID != "" {
+			user, err := database.FetchUserByExternalID(ctx, requestData.ExternalID)
+			if err != nil {
+				writeError(w, r, "User segments updating error", err)
+				return
+			}
+			userId = user.ID
+		}
+
+		err = database.UpdateUserSegments(ctx, userId, requestData.SegmentsToAdd, requestData.SegmentToDelete)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("DB query error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "User segments updating error", err)
 			return
 		}
+	}
+}
 
-		filename := fmt.Sprintf("report_%04d-%02d.csv", requestData.Year, requestData.Month)
-		filepath := "reports/" + filename
-		file, err := os.Create(filepath)
+// createReport writes CSV report of history into reports dir and returns download link,
+// with stream=true the report is sent in response body instead
+func createReport(database *db.Service, reportsDir, publicURL string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		var fieldErrors []db.FieldError
+		stream := queryBool(r.URL.Query(), "stream", &fieldErrors)
+		if len(fieldErrors) > 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Invalid query parameters", fieldErrors...)
+			return
+		}
+		var requestData GetReportRequest
+		err := json.NewDecoder(r.Body).Decode(&requestData)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Report creating error: %v", err), http.StatusInternalServerError)
+			writeInvalidJSON(w, r, err)
 			return
 		}
-		defer func(file *os.File) {
-			err = file.Close()
+
+		filter := db.HistoryFilter{
+			From:         requestData.From,
+			To:           requestData.To,
+			SegmentSlugs: requestData.Segments,
+			UserIDs:      requestData.UserIDs,
+			Operation:    requestData.Operation,
+		}
+		byMonth := requestData.Year != 0 || requestData.Month != 0
+		periodErr := reportPeriodError(requestData, byMonth)
+		if periodErr != nil {
+			writeError(w, r, "Report creating error", periodErr)
+			return
+		}
+		if byMonth {
+			if !filter.From.IsZero() || !filter.To.IsZero() {
+				writeError(w, r, "Report creating error", &db.Error{
+					Kind:    db.ErrValidation,
+					Message: "report period is set by both month and range",
+					Details: []db.FieldError{{Field: "from", Message: "can't be combined with year and month"}},
+				})
+				return
+			}
+			filter.From, filter.To, err = database.MonthRange(requestData.Year, requestData.Month)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Report creating error: %v", err), http.StatusInternalServerError)
+				writeError(w, r, "Report creating error", err)
 				return
 			}
-		}(file)
+		}
+
+		filename := reportFilename(requestData, byMonth, filter)
 
-		writer := csv.NewWriter(file)
-		defer writer.Flush()
+		if stream {
+			streamReport(database, w, r, filter, filename)
+			return
+		}
+
+		// report is written to temporary file and then replaces previous one, so partial report is never downloaded
+		file, err := os.CreateTemp(reportsDir, filename+".*.tmp")
+		if err != nil {
+			writeError(w, r, "Report creating error", err)
+			return
+		}
+		err = writeReport(ctx, database, file, filter, nil)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), filepath.Join(reportsDir, filename))
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+			writeError(w, r, "Report creating error", err)
+			return
+		}
 
+		link := strings.TrimSuffix(publicURL, "/") + "/download_report/" + filename
+		err = json.NewEncoder(w).Encode(link)
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
+	}
+}
+
+// reportPeriodError requires report period to be set by month, range starting at from or explicit all
+func reportPeriodError(requestData GetReportRequest, byMonth bool) error {
+	hasPeriod := byMonth || !requestData.From.IsZero() || !requestData.To.IsZero()
+	if requestData.All && hasPeriod {
+		return &db.Error{
+			Kind:    db.ErrValidation,
+			Message: "report of whole history can't have period",
+			Details: []db.FieldError{{Field: "all", Message: "can't be combined with year, month, from and to"}},
+		}
+	}
+	if !requestData.All && !byMonth && requestData.From.IsZero() {
+		return &db.Error{
+			Kind:    db.ErrValidation,
+			Message: "report period is required",
+			Details: []db.FieldError{{Field: "from", Message: "is required without year and month, set all to report whole history"}},
+		}
+	}
+	return nil
+}
+
+// reportFilename names report after its filter, so repeated report replaces previous file instead of adding new one
+func reportFilename(requestData GetReportRequest, byMonth bool, filter db.HistoryFilter) string {
+	if byMonth && len(filter.SegmentSlugs) == 0 && len(filter.UserIDs) == 0 && filter.Operation == "" {
+		return fmt.Sprintf("report_%04d-%02d.csv", requestData.Year, requestData.Month)
+	}
+	slugs := append([]string{}, filter.SegmentSlugs...)
+	sort.Strings(slugs)
+	userIds := make([]string, 0, len(filter.UserIDs))
+	for _, userId := range filter.UserIDs {
+		userIds = append(userIds, userId.String())
+	}
+	sort.Strings(userIds)
+	key := strings.Join([]string{
+		filter.From.UTC().Format(time.RFC3339Nano),
+		filter.To.UTC().Format(time.RFC3339Nano),
+		strings.Join(slugs, ","),
+		strings.Join(userIds, ","),
+		filter.Operation,
+	}, "|")
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("report_%x.csv", sum[:8])
+}
+
+// writeReport writes report rows to w batch by batch, flush is called after each batch if it is set
+func writeReport(ctx context.Context, database *db.Service, w io.Writer, filter db.HistoryFilter, flush func()) error {
+	writer := csv.NewWriter(w)
+	location := database.ReportLocation()
+	err := database.StreamHistory(ctx, filter, func(entries []db.GetHistory) error {
 		for _, entry := range entries {
-			err = writer.Write([]string{
-				"идентификатор пользователя " + entry.UserID.String(),
+			user := "идентификатор пользователя " + entry.UserID.String()
+			if entry.UserID == uuid.Nil {
+				user = "данные пользователя удалены"
+			}
+			err := writer.Write([]string{
+				user,
 				entry.Slug,
 				entry.Operation,
-				entry.OperationAt.Format("2006-01-02 15:04:05"),
+				entry.OperationAt.In(location).Format("2006-01-02 15:04:05"),
+				entry.Description,
+				entry.Owner,
+				strings.Join(entry.Tags, ";"),
 			})
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Report creating error: %v", err), http.StatusInternalServerError)
-				return
+				return err
 			}
 		}
-		link := "localhost:8000/download_report/" + filename
-		err = json.NewEncoder(w).Encode(link)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Json encode error: %v", err), http.StatusInternalServerError)
+		writer.Flush()
+		if flush != nil {
+			flush()
 		}
+		return writer.Error()
+	})
+	if err != nil {
+		return err
 	}
+	writer.Flush()
+	return writer.Error()
 }
 
-func downloadReport(w http.ResponseWriter, _ *http.Request, routerParams httprouter.Params) {
-	filename := routerParams.ByName("filename")
-	filePath := "reports/" + filename
+// streamReport sends report in response body, each batch of rows is flushed to the client as soon as it is read
+func streamReport(database *db.Service, w http.ResponseWriter, r *http.Request, filter db.HistoryFilter, filename string) {
+	ctx := r.Context()
+	flusher, _ := w.(http.Flusher)
+
+	// headers are sent with the first row, so invalid filter or db error still gets problem response
+	response := &startedWriter{w: w, start: func() {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	}}
+	err := writeReport(ctx, database, response, filter, func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	if err != nil && !response.started {
+		writeError(w, r, "Report creating error", err)
+	} else if err != nil {
+		// response is already partially sent, abort it so the client doesn't take truncated report for complete one
+		log.Printf("Request %s report streaming error: %v\n", requestID(ctx), err)
+		panic(http.ErrAbortHandler)
+	} else if !response.started {
+		// empty report
+		response.start()
+		w.WriteHeader(http.StatusOK)
+	}
+}
 
-	// Открываем файл для чтения
-	file, err := os.Open(filePath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("File opening error: %v", err), http.StatusInternalServerError)
-		return
+// startedWriter calls start before the first write
+type startedWriter struct {
+	w       io.Writer
+	start   func()
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.start()
 	}
-	defer func(file *os.File) {
-		err = file.Close()
+	return s.w.Write(p)
+}
+
+func downloadReport(reportsDir string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		filename := routerParams.ByName("filename")
+		filePath := filepath.Join(reportsDir, filepath.Base(filename))
+
+		// Открываем файл для чтения
+		file, err := os.Open(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("Report %s not found", filename))
+			return
+		} else if err != nil {
+			writeError(w, r, "File opening error", err)
+			return
+		}
+		defer func(file *os.File) {
+			err = file.Close()
+			if err != nil {
+				writeError(w, r, "File closing error", err)
+				return
+			}
+		}(file)
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+		_, err = io.Copy(w, file)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("File closing error: %v", err), http.StatusInternalServerError)
+			writeError(w, r, "File sending error", err)
 			return
 		}
-	}(file)
+	}
+}
 
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+func getRunnerLeader(leadership runner.Leadership, instanceId string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ctx := r.Context()
+		leader, err := leadership.Leader(ctx)
+		if err != nil {
+			writeError(w, r, "Leader fetching error", err)
+			return
+		}
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("File sending error: %v", err), http.StatusInternalServerError)
-		return
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(RunnerLeaderResponse{
+			InstanceID: instanceId,
+			Leader:     leader,
+			IsLeader:   leader == instanceId,
+		})
+		if err != nil {
+			writeError(w, r, "Json encode error", err)
+		}
 	}
 }
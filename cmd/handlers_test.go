@@ -0,0 +1,1284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nazarovlex/AVITO_TASK/internal/config"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddSegmentsToUserIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+	userId := userIds[0]
+	for _, slug := range []string{"OLD", "NEW", "ADDED"} {
+		_, err = database.CreateSegment(ctx, db.Segments{Slug: slug})
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+	segment, err := database.FetchSegment(ctx, "ADDED")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	err = database.AddUserSegments(ctx, userId, segment.ID, time.Time{})
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+	oldSegment, err := database.FetchSegment(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	err = database.AddUserSegments(ctx, userId, oldSegment.ID, time.Time{})
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+
+	// ADDED is already assigned, so the whole request must be rolled back
+	body := `{"user_id": "` + userId.String() + `", "segments_to_add": {"NEW": 1, "ADDED": 1}, "segment_to_delete": ["OLD"]}`
+	request := httptest.NewRequest(http.MethodPost, "/user_segments", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	addSegmentsToUser(database)(recorder, request, httprouter.Params{})
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusConflict, recorder.Body)
+	}
+
+	user, err := database.FetchUser(ctx, userId)
+	if err != nil {
+		t.Fatalf("FetchUser: %v", err)
+	}
+	if strings.Join(user.SegmentSlugs, ",") != "ADDED,OLD" {
+		t.Fatalf("user segments are %v after failed request, want [ADDED OLD]", user.SegmentSlugs)
+	}
+	history, err := database.GetHistory(ctx, db.HistoryFilter{})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("failed request left history %+v", history)
+	}
+}
+
+func TestCreateSegmentEnrollsPercentOfUsers(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	for i := 0; i < 10; i++ {
+		_, err := database.CreateUser(ctx, db.Users{Name: "user"})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/segments", strings.NewReader(`{"slug": "ALL", "percent": 100}`))
+	recorder := httptest.NewRecorder()
+	createSegment(database)(recorder, request, httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+
+	page, err := database.FetchUsers(ctx, db.UsersFilter{}, "")
+	if err != nil {
+		t.Fatalf("FetchUsers: %v", err)
+	}
+	for _, user := range page.Users {
+		if len(user.SegmentSlugs) != 1 || user.SegmentSlugs[0] != "ALL" {
+			t.Fatalf("user %v has segments %v, want [ALL]", user.UserID, user.SegmentSlugs)
+		}
+	}
+
+	// new users are bucketed into existing rollout segments too
+	_, err = database.CreateUser(ctx, db.Users{Name: "late user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	page, err = database.FetchUsers(ctx, db.UsersFilter{}, "")
+	if err != nil {
+		t.Fatalf("FetchUsers: %v", err)
+	}
+	for _, user := range page.Users {
+		if len(user.SegmentSlugs) != 1 {
+			t.Fatalf("user %v has segments %v, want [ALL]", user.UserID, user.SegmentSlugs)
+		}
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/segments", strings.NewReader(`{"slug": "INVALID", "percent": 101}`))
+	recorder = httptest.NewRecorder()
+	createSegment(database)(recorder, request, httprouter.Params{})
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestCreateReturnsResource(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+
+	// deletion can't be set by client
+	request := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name": "Aleksey", "deleted_at": "2020-01-01T00:00:00Z"}`))
+	recorder := httptest.NewRecorder()
+	createUser(database)(recorder, request, httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	var user db.Users
+	err := json.NewDecoder(recorder.Body).Decode(&user)
+	if err != nil {
+		t.Fatalf("user decoding: %v", err)
+	}
+	if user.Name != "Aleksey" || user.DeletedAt != nil || recorder.Header().Get("Location") != "/users/"+user.ID.String() {
+		t.Fatalf("got user %+v at %q", user, recorder.Header().Get("Location"))
+	}
+	if exists, err := database.CheckExistedUser(ctx, user.ID); err != nil || !exists {
+		t.Fatalf("returned user %v doesn't exist: %v", user.ID, err)
+	}
+	deletedAt := time.Now()
+	created, err := database.CreateUser(ctx, db.Users{Name: "deleted", DeletedAt: &deletedAt})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if exists, err := database.CheckExistedUser(ctx, created.ID); err != nil || !exists {
+		t.Fatalf("user %v created with deletion time doesn't exist: %v", created.ID, err)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/segments", strings.NewReader(`{"slug": "AVITO VOICE", "percent": 10}`))
+	recorder = httptest.NewRecorder()
+	createSegment(database)(recorder, request, httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	var segment db.Segments
+	err = json.NewDecoder(recorder.Body).Decode(&segment)
+	if err != nil {
+		t.Fatalf("segment decoding: %v", err)
+	}
+	fetched, err := database.FetchSegment(ctx, "AVITO VOICE")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if segment.ID != fetched.ID || segment.Percent != 10 || segment.Salt != "" {
+		t.Fatalf("got segment %+v, want %+v without salt", segment, fetched)
+	}
+	if recorder.Header().Get("Location") != "/segments/AVITO%20VOICE" {
+		t.Fatalf("got location %q", recorder.Header().Get("Location"))
+	}
+}
+
+func TestUserExternalID(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+
+	userId := uuid.New()
+	body := `{"id": "` + userId.String() + `", "name": "user", "external_id": "account-1"}`
+	recorder := httptest.NewRecorder()
+	createUser(database)(recorder, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)), httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	recorder = httptest.NewRecorder()
+	createUser(database)(recorder, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name": "other", "external_id": "account-1"}`)), httprouter.Params{})
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("duplicate external id: got status %d, want %d", recorder.Code, http.StatusConflict)
+	}
+
+	body = `{"external_id": "account-1", "segments_to_add": {"SEGMENT": 0}}`
+	recorder = httptest.NewRecorder()
+	addSegmentsToUser(database)(recorder, httptest.NewRequest(http.MethodPost, "/user_segments", strings.NewReader(body)), httprouter.Params{})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/users/account-1?key=external_id", nil)
+	getUser(database)(recorder, request, httprouter.Params{{Key: "id", Value: "account-1"}})
+	var user map[string]interface{}
+	err = json.NewDecoder(recorder.Body).Decode(&user)
+	if err != nil {
+		t.Fatalf("user decoding: %v", err)
+	}
+	// single user keeps field names it had before users listing
+	want := map[string]interface{}{
+		"UserID":       userId.String(),
+		"Name":         "user",
+		"ExternalID":   "account-1",
+		"SegmentSlugs": []interface{}{"SEGMENT"},
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Fatalf("got user %v, want %v", user, want)
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodDelete, "/users/unknown?key=external_id", nil)
+	deleteUser(database)(recorder, request, httprouter.Params{{Key: "id", Value: "unknown"}})
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("unknown external id: got status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestGetUsersPages(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	for _, name := range []string{"c", "a", "b"} {
+		_, err := database.CreateUser(ctx, db.Users{Name: name})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+
+	var names []string
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		request := httptest.NewRequest(http.MethodGet, "/users?sort=name&limit=2&cursor="+cursor, nil)
+		recorder := httptest.NewRecorder()
+		getUsers(database)(recorder, request, httprouter.Params{})
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var page db.UsersPage
+		err := json.NewDecoder(recorder.Body).Decode(&page)
+		if err != nil {
+			t.Fatalf("page decoding: %v", err)
+		}
+		for _, user := range page.Users {
+			names = append(names, user.Name)
+		}
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if strings.Join(names, ",") != "a,b,c" {
+		t.Fatalf("got users %v, want [a b c]", names)
+	}
+
+	for query, status := range map[string]int{
+		"limit=x":                       http.StatusBadRequest,
+		"limit=5000":                    http.StatusUnprocessableEntity,
+		"sort=age":                      http.StatusUnprocessableEntity,
+		"cursor=bad":                    http.StatusUnprocessableEntity,
+		"segment=A&no_segments=true":    http.StatusUnprocessableEntity,
+		"no_segments=true&name_prefix=": http.StatusOK,
+	} {
+		recorder := httptest.NewRecorder()
+		getUsers(database)(recorder, httptest.NewRequest(http.MethodGet, "/users?"+query, nil), httprouter.Params{})
+		if recorder.Code != status {
+			t.Errorf("%s: got status %d, want %d: %s", query, recorder.Code, status, recorder.Body)
+		}
+	}
+}
+
+func TestGetSegments(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for _, slug := range []string{"C", "A", "B"} {
+		_, err = database.CreateSegment(ctx, db.Segments{Slug: slug, Percent: 100})
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+
+	var slugs []string
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		recorder := httptest.NewRecorder()
+		getSegments(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments?limit=2&cursor="+cursor, nil), httprouter.Params{})
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var page db.SegmentsPage
+		err = json.NewDecoder(recorder.Body).Decode(&page)
+		if err != nil {
+			t.Fatalf("page decoding: %v", err)
+		}
+		for _, segment := range page.Segments {
+			slugs = append(slugs, segment.Slug)
+		}
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if strings.Join(slugs, ",") != "A,B,C" {
+		t.Fatalf("got segments %v, want [A B C]", slugs)
+	}
+
+	recorder := httptest.NewRecorder()
+	getSegment(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/B", nil), httprouter.Params{{Key: "slug", Value: "B"}})
+	var segment db.SegmentDetails
+	err = json.NewDecoder(recorder.Body).Decode(&segment)
+	if err != nil {
+		t.Fatalf("segment decoding: %v", err)
+	}
+	if segment.Slug != "B" || segment.Percent != 100 || segment.MemberCount != 1 || segment.CreatedAt.IsZero() {
+		t.Fatalf("got segment %+v, want B with user %v", segment, user.ID)
+	}
+
+	recorder = httptest.NewRecorder()
+	getSegment(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/UNKNOWN", nil), httprouter.Params{{Key: "slug", Value: "UNKNOWN"}})
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestSegmentMetadata(t *testing.T) {
+	database := db.NewService(db.NewMemory())
+	body := `{"slug": "VOICE", "description": "voice messages", "owner": "messenger", "tags": ["chat", " chat ", ""]}`
+	recorder := httptest.NewRecorder()
+	createSegment(database)(recorder, httptest.NewRequest(http.MethodPost, "/segments", strings.NewReader(body)), httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	getSegments(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments?owner=messenger&tag=chat", nil), httprouter.Params{})
+	var page db.SegmentsPage
+	err := json.NewDecoder(recorder.Body).Decode(&page)
+	if err != nil {
+		t.Fatalf("page decoding: %v", err)
+	}
+	if len(page.Segments) != 1 || page.Segments[0].Description != "voice messages" || strings.Join(page.Segments[0].Tags, ",") != "chat" {
+		t.Fatalf("got segments %+v, want VOICE with normalized tags", page.Segments)
+	}
+}
+
+func TestCreateSegmentIgnoresServerFields(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	body := `{"slug": "VOICE", "percent": 100, "created_at": "1999-01-01T00:00:00Z", "updated_at": "1999-01-01T00:00:00Z", "archived_at": "2020-01-01T00:00:00Z"}`
+	recorder := httptest.NewRecorder()
+	createSegment(database)(recorder, httptest.NewRequest(http.MethodPost, "/segments", strings.NewReader(body)), httprouter.Params{})
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	var segment db.Segments
+	err = json.NewDecoder(recorder.Body).Decode(&segment)
+	if err != nil {
+		t.Fatalf("segment decoding: %v", err)
+	}
+	if time.Since(segment.CreatedAt) > time.Minute || !segment.UpdatedAt.Equal(segment.CreatedAt) || segment.Archived() {
+		t.Fatalf("got segment %+v, want active segment with timestamps set by server", segment)
+	}
+
+	// service never creates archived segment with rollout members
+	archivedAt := time.Now()
+	created, err := database.CreateSegment(ctx, db.Segments{Slug: "ARCHIVED", Percent: 100, ArchivedAt: &archivedAt})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	if created.Archived() {
+		t.Fatalf("got segment %+v, want active", created)
+	}
+}
+
+func TestUpdateSegmentBySlug(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	for _, slug := range []string{"OLD", "TAKEN"} {
+		_, err := database.CreateSegment(ctx, db.Segments{Slug: slug, Owner: "team"})
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+	update := func(slug, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, "/segments/"+slug, strings.NewReader(body))
+		updateSegment(database)(recorder, request, httprouter.Params{{Key: "slug", Value: slug}})
+		return recorder
+	}
+
+	recorder := update("OLD", `{"slug": "NEW", "description": "renamed"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	var segment db.Segments
+	err := json.NewDecoder(recorder.Body).Decode(&segment)
+	if err != nil {
+		t.Fatalf("segment decoding: %v", err)
+	}
+	if segment.Slug != "NEW" || segment.Description != "renamed" || segment.Owner != "" {
+		t.Fatalf("got segment %+v, want NEW with replaced metadata", segment)
+	}
+
+	// old slug is alias of renamed segment
+	fetched, err := database.FetchSegment(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if fetched.ID != segment.ID || fetched.Slug != "NEW" {
+		t.Fatalf("old slug resolved to %+v, want %+v", fetched, segment)
+	}
+	// empty slug in body keeps current slug, segment can be addressed by alias
+	recorder = update("OLD", `{"owner": "platform"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	fetched, err = database.FetchSegment(ctx, "NEW")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if fetched.Owner != "platform" {
+		t.Fatalf("got segment %+v, want owner platform", fetched)
+	}
+
+	for _, test := range []struct {
+		slug   string
+		body   string
+		status int
+	}{
+		{"UNKNOWN", `{"slug": "OTHER"}`, http.StatusNotFound},
+		{"NEW", `{"slug": "TAKEN"}`, http.StatusConflict},
+		{"NEW", `{`, http.StatusBadRequest},
+	} {
+		recorder = update(test.slug, test.body)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d: %s", test.slug, test.body, recorder.Code, test.status, recorder.Body)
+		}
+	}
+
+	// archive by alias
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodDelete, "/segments/OLD", nil)
+	deleteSegment(database)(recorder, request, httprouter.Params{{Key: "slug", Value: "OLD"}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	fetched, err = database.FetchSegment(ctx, "NEW")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if !fetched.Archived() {
+		t.Fatalf("got segment %+v, want archived", fetched)
+	}
+	_, err = database.CreateSegment(ctx, db.Segments{Slug: "OLD"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+
+	// renamed segment can take its previous slug back
+	recorder = update("TAKEN", `{"slug": "TAKEN2"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	recorder = update("TAKEN2", `{"slug": "TAKEN"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	fetched, err = database.FetchSegment(ctx, "TAKEN2")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if fetched.Slug != "TAKEN" {
+		t.Fatalf("TAKEN2 resolved to %+v, want TAKEN", fetched)
+	}
+}
+
+func TestArchiveSegment(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	_, err = database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT", Percent: 100})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	params := httprouter.Params{{Key: "slug", Value: "SEGMENT"}}
+	archive := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		deleteSegment(database)(recorder, httptest.NewRequest(http.MethodDelete, target, nil), params)
+		return recorder
+	}
+	restore := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		restoreSegment(database)(recorder, httptest.NewRequest(http.MethodPost, "/segments/SEGMENT/restore", nil), params)
+		return recorder
+	}
+	assertSlugs := func(userId uuid.UUID, want string) {
+		t.Helper()
+		fetched, err := database.FetchUser(ctx, userId)
+		if err != nil {
+			t.Fatalf("FetchUser: %v", err)
+		}
+		if got := strings.Join(fetched.SegmentSlugs, ","); got != want {
+			t.Fatalf("got user segments %q, want %q", got, want)
+		}
+	}
+
+	// purge of active segment is rejected
+	recorder := archive("/segments/SEGMENT?purge=true")
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("purge of active segment: got status %d, want %d: %s", recorder.Code, http.StatusConflict, recorder.Body)
+	}
+
+	// archiving twice returns archived segment both times
+	for i := 0; i < 2; i++ {
+		recorder = archive("/segments/SEGMENT")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var segment db.Segments
+		err = json.NewDecoder(recorder.Body).Decode(&segment)
+		if err != nil {
+			t.Fatalf("segment decoding: %v", err)
+		}
+		if !segment.Archived() {
+			t.Fatalf("got segment %+v, want archived", segment)
+		}
+	}
+	assertSlugs(user.ID, "")
+
+	// archived segment stays in history and can't be assigned or enrolled
+	history, err := database.GetHistory(ctx, db.HistoryFilter{})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history) != 2 || history[1].Operation != db.OperationDelete || history[1].Slug != "SEGMENT" {
+		t.Fatalf("got history %+v, want rollout addition and removal", history)
+	}
+	err = database.UpdateUserSegments(ctx, user.ID, map[string]int{"SEGMENT": 0}, nil)
+	if !errors.Is(err, db.ErrValidation) {
+		t.Fatalf("adding archived segment: got %v, want validation error", err)
+	}
+	newUser, err := database.CreateUser(ctx, db.Users{Name: "new"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	assertSlugs(newUser.ID, "")
+
+	for _, test := range []struct {
+		target string
+		want   int
+	}{
+		{"/segments", 0},
+		{"/segments?archived=true", 1},
+	} {
+		recorder = httptest.NewRecorder()
+		getSegments(database)(recorder, httptest.NewRequest(http.MethodGet, test.target, nil), httprouter.Params{})
+		var page db.SegmentsPage
+		err = json.NewDecoder(recorder.Body).Decode(&page)
+		if err != nil {
+			t.Fatalf("page decoding: %v", err)
+		}
+		if len(page.Segments) != test.want {
+			t.Fatalf("%s: got segments %+v, want %d", test.target, page.Segments, test.want)
+		}
+	}
+
+	// restored segment enrolls users by percent again
+	recorder = restore()
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	assertSlugs(user.ID, "SEGMENT")
+	assertSlugs(newUser.ID, "SEGMENT")
+	recorder = restore()
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("restore of active segment: got status %d, want %d: %s", recorder.Code, http.StatusConflict, recorder.Body)
+	}
+
+	// purge deletes segment with its history
+	archive("/segments/SEGMENT")
+	recorder = archive("/segments/SEGMENT?purge=true")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusNoContent, recorder.Body)
+	}
+	_, err = database.FetchSegment(ctx, "SEGMENT")
+	if !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("FetchSegment of purged segment: got %v, want not found", err)
+	}
+	history, err = database.GetHistory(ctx, db.HistoryFilter{})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("got history %+v of purged segment, want none", history)
+	}
+	recorder = restore()
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("restore of purged segment: got status %d, want %d: %s", recorder.Code, http.StatusNotFound, recorder.Body)
+	}
+}
+
+func TestDeleteUserKeepsHistory(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	var userIds []uuid.UUID
+	for _, externalId := range []string{"deleted", "erased"} {
+		user, err := database.CreateUser(ctx, db.Users{Name: "user", ExternalID: externalId})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		err = database.UpdateUserSegments(ctx, user.ID, map[string]int{"SEGMENT": 0}, nil)
+		if err != nil {
+			t.Fatalf("UpdateUserSegments: %v", err)
+		}
+		userIds = append(userIds, user.ID)
+	}
+	deleteUserBy := func(target, externalId string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		deleteUser(database)(recorder, httptest.NewRequest(http.MethodDelete, target, nil), httprouter.Params{{Key: "id", Value: externalId}})
+		return recorder
+	}
+
+	recorder := deleteUserBy("/users/deleted?key=external_id", "deleted")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	_, err = database.FetchUser(ctx, userIds[0])
+	if !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("FetchUser of deleted user: got %v, want not found", err)
+	}
+	recorder = deleteUserBy("/users/erased?key=external_id&erase=true", "erased")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusNoContent, recorder.Body)
+	}
+	recorder = deleteUserBy("/users/erased?key=external_id&erase=true", "erased")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("erasing erased user: got status %d, want %d: %s", recorder.Code, http.StatusNotFound, recorder.Body)
+	}
+
+	// deleted user has its addition and removal in report, erased user has the same entries anonymized
+	recorder = httptest.NewRecorder()
+	body := fmt.Sprintf(`{"year": %d, "month": %d}`, time.Now().UTC().Year(), time.Now().UTC().Month())
+	reportsDir := t.TempDir()
+	createReport(database, reportsDir, "http://localhost")(recorder, httptest.NewRequest(http.MethodGet, "/get_report", strings.NewReader(body)), nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	var link string
+	err = json.NewDecoder(recorder.Body).Decode(&link)
+	if err != nil {
+		t.Fatalf("link decoding: %v", err)
+	}
+	report, err := os.ReadFile(filepath.Join(reportsDir, path.Base(link)))
+	if err != nil {
+		t.Fatalf("report reading: %v", err)
+	}
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(report)), "\n") {
+		user := strings.Split(line, ",")[0]
+		counts[user+" "+strings.Split(line, ",")[2]]++
+	}
+	want := map[string]int{
+		"идентификатор пользователя " + userIds[0].String() + " " + db.OperationAdd:    1,
+		"идентификатор пользователя " + userIds[0].String() + " " + db.OperationDelete: 1,
+		"данные пользователя удалены " + db.OperationAdd:                               1,
+		"данные пользователя удалены " + db.OperationDelete:                            1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("got report entries %v, want %v:\n%s", counts, want, report)
+	}
+}
+
+func TestCreateReportPeriod(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	location, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	database.SetReportLocation(location)
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	segments := map[string]uuid.UUID{}
+	for _, slug := range []string{"A", "B"} {
+		segment, err := database.CreateSegment(ctx, db.Segments{Slug: slug})
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+		segments[slug] = segment.ID
+	}
+	// August in Moscow starts at 21:00 UTC of July 31
+	for _, entry := range []db.UserSegmentHistory{
+		{UserID: user.ID, SegmentID: segments["A"], Operation: db.OperationAdd, OperationAt: time.Date(2023, time.July, 31, 20, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, SegmentID: segments["A"], Operation: db.OperationDelete, OperationAt: time.Date(2023, time.July, 31, 22, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, SegmentID: segments["B"], Operation: db.OperationAdd, OperationAt: time.Date(2023, time.August, 15, 12, 0, 0, 0, time.UTC)},
+		{UserID: user.ID, SegmentID: segments["B"], Operation: db.OperationDelete, OperationAt: time.Date(2023, time.August, 31, 22, 0, 0, 0, time.UTC)},
+	} {
+		err = database.SaveHistory(ctx, entry)
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	reportsDir := t.TempDir()
+	report := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		createReport(database, reportsDir, "http://localhost")(recorder, httptest.NewRequest(http.MethodGet, "/get_report", strings.NewReader(body)), nil)
+		return recorder
+	}
+	for _, test := range []struct {
+		body string
+		want []string
+	}{
+		{`{"year": 2023, "month": 8}`, []string{"A " + db.OperationDelete + " 2023-08-01 01:00:00", "B " + db.OperationAdd + " 2023-08-15 15:00:00"}},
+		{`{"from": "2023-08-01T00:00:00Z", "operation": "` + db.OperationDelete + `"}`, []string{"B " + db.OperationDelete + " 2023-09-01 01:00:00"}},
+		{fmt.Sprintf(`{"from": "2023-07-01T00:00:00Z", "to": "2023-08-01T00:00:00Z", "segments": ["A"], "user_ids": [%q]}`, user.ID), []string{"A " + db.OperationAdd + " 2023-07-31 23:00:00", "A " + db.OperationDelete + " 2023-08-01 01:00:00"}},
+		{`{"all": true, "segments": ["B"]}`, []string{"B " + db.OperationAdd + " 2023-08-15 15:00:00", "B " + db.OperationDelete + " 2023-09-01 01:00:00"}},
+	} {
+		recorder := report(test.body)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d: %s", test.body, recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var link string
+		err = json.NewDecoder(recorder.Body).Decode(&link)
+		if err != nil {
+			t.Fatalf("link decoding: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(reportsDir, path.Base(link)))
+		if err != nil {
+			t.Fatalf("report reading: %v", err)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			columns := strings.Split(line, ",")
+			got = append(got, columns[1]+" "+columns[2]+" "+columns[3])
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: got report %v, want %v", test.body, got, test.want)
+		}
+	}
+
+	// repeated reports replace previous files
+	for _, body := range []string{`{"year": 2023, "month": 8}`, `{"all": true, "segments": ["B"]}`} {
+		if recorder := report(body); recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d: %s", body, recorder.Code, http.StatusOK, recorder.Body)
+		}
+	}
+	files, err := os.ReadDir(reportsDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("got %d report files, want 4", len(files))
+	}
+
+	for _, body := range []string{
+		`{"year": 2023, "month": 8, "from": "2023-08-01T00:00:00Z"}`,
+		`{"year": 2023, "month": 13}`,
+		`{"from": "2023-08-01T00:00:00Z", "to": "2023-08-01T00:00:00Z"}`,
+		`{"from": "2023-08-01T00:00:00Z", "operation": "unknown"}`,
+		`{}`,
+		`{"to": "2023-08-01T00:00:00Z"}`,
+		`{"all": true, "year": 2023, "month": 8}`,
+	} {
+		if problem := decodeProblem(t, report(body)); problem.Status != http.StatusUnprocessableEntity || problem.Code != codeValidation {
+			t.Fatalf("%s: got problem %+v, want validation error", body, problem)
+		}
+	}
+}
+
+func TestCreateReportStream(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	segment, err := database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	// more entries than single batch
+	start := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 1500; i++ {
+		err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	reportsDir := t.TempDir()
+	report := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		createReport(database, reportsDir, "http://localhost")(recorder, httptest.NewRequest(http.MethodGet, "/get_report?stream=true", strings.NewReader(body)), nil)
+		return recorder
+	}
+	recorder := report(`{"year": 2023, "month": 8}`)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("got status %d with content type %q, want csv: %s", recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body)
+	}
+	if disposition := recorder.Header().Get("Content-Disposition"); disposition != "attachment; filename=report_2023-08.csv" {
+		t.Fatalf("got content disposition %q", disposition)
+	}
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 1500 || !strings.Contains(lines[1499], "2023-08-02 00:59:00") {
+		t.Fatalf("got %d report lines ending with %q, want 1500", len(lines), lines[len(lines)-1])
+	}
+	files, err := os.ReadDir(reportsDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("streamed report left files %v", files)
+	}
+
+	recorder = report(`{"year": 2023, "month": 9}`)
+	if recorder.Code != http.StatusOK || recorder.Body.Len() != 0 {
+		t.Fatalf("got status %d with body %q, want empty report", recorder.Code, recorder.Body)
+	}
+	if problem := decodeProblem(t, report(`{"operation": "unknown"}`)); problem.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("got problem %+v, want validation error", problem)
+	}
+}
+
+func TestGetUserSegmentsAt(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for _, slug := range []string{"REMOVED", "KEPT"} {
+		_, err = database.CreateSegment(ctx, db.Segments{Slug: slug})
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+	err = database.UpdateUserSegments(ctx, user.ID, map[string]int{"REMOVED": 0, "KEPT": 1}, nil)
+	if err != nil {
+		t.Fatalf("UpdateUserSegments: %v", err)
+	}
+	beforeRemoval := time.Now()
+	err = database.UpdateUserSegments(ctx, user.ID, nil, []string{"REMOVED"})
+	if err != nil {
+		t.Fatalf("UpdateUserSegments: %v", err)
+	}
+	params := httprouter.Params{{Key: "id", Value: user.ID.String()}}
+
+	for _, test := range []struct {
+		at   time.Time
+		want string
+	}{
+		{beforeRemoval, "KEPT,REMOVED"},
+		{time.Now(), "KEPT"},
+		{time.Now().Add(2 * time.Hour), ""},
+	} {
+		recorder := httptest.NewRecorder()
+		target := "/users/" + user.ID.String() + "/segments?at=" + url.QueryEscape(test.at.Format(time.RFC3339Nano))
+		getUserSegmentsAt(database)(recorder, httptest.NewRequest(http.MethodGet, target, nil), params)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var response UserSegmentsResponse
+		err = json.NewDecoder(recorder.Body).Decode(&response)
+		if err != nil {
+			t.Fatalf("response decoding: %v", err)
+		}
+		var slugs []string
+		for _, segment := range response.Segments {
+			slugs = append(slugs, segment.Slug)
+		}
+		if strings.Join(slugs, ",") != test.want || !response.At.Equal(test.at) {
+			t.Fatalf("at %v got segments %v at %v, want %s", test.at, slugs, response.At, test.want)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	getUserSegmentsAt(database)(recorder, httptest.NewRequest(http.MethodGet, "/users/"+user.ID.String()+"/segments?at=yesterday", nil), params)
+	if problem := decodeProblem(t, recorder); problem.Status != http.StatusBadRequest || problem.Code != codeInvalidQuery {
+		t.Fatalf("got problem %+v, want invalid query", problem)
+	}
+}
+
+func TestGetUserHistory(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	for _, segment := range []db.Segments{{Slug: "ROLLOUT", Percent: 100}, {Slug: "TTL"}} {
+		_, err := database.CreateSegment(ctx, segment)
+		if err != nil {
+			t.Fatalf("CreateSegment: %v", err)
+		}
+	}
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	body := fmt.Sprintf(`{"user_id": %q, "segments_to_add": {"TTL": 10}, "segment_to_delete": ["ROLLOUT"]}`, user.ID)
+	request := httptest.NewRequest(http.MethodPost, "/user_segments", strings.NewReader(body))
+	request.Header.Set("X-Actor", "support")
+	recorder := httptest.NewRecorder()
+	withActor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addSegmentsToUser(database)(w, r, httprouter.Params{})
+	})).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	params := httprouter.Params{{Key: "id", Value: user.ID.String()}}
+	getHistory := func(query string) db.UserHistoryPage {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		getUserHistory(database)(recorder, httptest.NewRequest(http.MethodGet, "/users/"+user.ID.String()+"/history?"+query, nil), params)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+		}
+		var page db.UserHistoryPage
+		err := json.NewDecoder(recorder.Body).Decode(&page)
+		if err != nil {
+			t.Fatalf("response decoding: %v", err)
+		}
+		return page
+	}
+
+	var events []db.HistoryEvent
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		page := getHistory("limit=2&cursor=" + cursor)
+		events = append(events, page.Events...)
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	if cursor != "" || len(events) != 3 {
+		t.Fatalf("got events %+v with next cursor %q, want 3 events on 2 pages", events, cursor)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, fmt.Sprintf("%s %s %s %d", event.Slug, event.Operation, event.Actor, event.TTLHours))
+	}
+	want := []string{
+		"ROLLOUT " + db.OperationAdd + " system 0",
+		"ROLLOUT " + db.OperationDelete + " support 0",
+		"TTL " + db.OperationAdd + " support 10",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+
+	page := getHistory("segment=TTL&from=" + url.QueryEscape(events[2].OperationAt.Format(time.RFC3339Nano)))
+	if len(page.Events) != 1 || page.Events[0].Slug != "TTL" || page.Events[0].ExpiresAt == nil {
+		t.Fatalf("got filtered events %+v, want addition of TTL", page.Events)
+	}
+
+	recorder = httptest.NewRecorder()
+	getUserHistory(database)(recorder, httptest.NewRequest(http.MethodGet, "/users/"+user.ID.String()+"/history?from=yesterday", nil), params)
+	if problem := decodeProblem(t, recorder); problem.Status != http.StatusBadRequest || problem.Code != codeInvalidQuery {
+		t.Fatalf("got problem %+v, want invalid query", problem)
+	}
+}
+
+func TestGetSegmentMembers(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		user, err := database.CreateUser(ctx, db.Users{Name: name})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		err = database.UpdateUserSegments(ctx, user.ID, map[string]int{"SEGMENT": 0}, nil)
+		if err != nil {
+			t.Fatalf("UpdateUserSegments: %v", err)
+		}
+	}
+	params := httprouter.Params{{Key: "slug", Value: "SEGMENT"}}
+
+	recorder := httptest.NewRecorder()
+	getSegmentMembers(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/SEGMENT/users?limit=2", nil), params)
+	var page db.SegmentMembersPage
+	err = json.NewDecoder(recorder.Body).Decode(&page)
+	if err != nil {
+		t.Fatalf("page decoding: %v", err)
+	}
+	if len(page.Members) != 2 || page.NextCursor == "" {
+		t.Fatalf("got page %+v, want 2 members and next cursor", page)
+	}
+
+	recorder = httptest.NewRecorder()
+	getSegmentMembers(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/SEGMENT/users?format=csv", nil), params)
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if recorder.Header().Get("Content-Type") != "text/csv" || len(lines) != 4 || lines[0] != "user_id,name,external_id,expires_at" {
+		t.Fatalf("got csv %q", recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	getSegmentMembers(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/SEGMENT/users?format=ndjson", nil), params)
+	decoder := json.NewDecoder(recorder.Body)
+	count := 0
+	for decoder.More() {
+		var member db.SegmentMember
+		err = decoder.Decode(&member)
+		if err != nil {
+			t.Fatalf("member decoding: %v", err)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("got %d members in ndjson, want 3", count)
+	}
+
+	recorder = httptest.NewRecorder()
+	getSegmentMembers(database)(recorder, httptest.NewRequest(http.MethodGet, "/segments/UNKNOWN/users?format=csv", nil), httprouter.Params{{Key: "slug", Value: "UNKNOWN"}})
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestExportTimeout(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	user, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	err = database.UpdateUserSegments(ctx, user.ID, map[string]int{"SEGMENT": 0}, nil)
+	if err != nil {
+		t.Fatalf("UpdateUserSegments: %v", err)
+	}
+	report := fmt.Sprintf(`{"year": %d, "month": %d}`, time.Now().Year(), time.Now().Month())
+
+	// requests go through the same middlewares as in serve
+	get := func(cfg config.Config, target, body string) (int, string) {
+		t.Helper()
+		cfg.ReportsDir = t.TempDir()
+		server := httptest.NewServer(newHandler(database, nil, cfg))
+		defer server.Close()
+		req, err := http.NewRequest(http.MethodGet, server.URL+target, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", target, err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("GET %s body: %v", target, err)
+		}
+		return resp.StatusCode, string(data)
+	}
+
+	// exports outlive request timeout, including report saved to file
+	cfg := config.Default()
+	cfg.RequestTimeout = time.Nanosecond
+	status, body := get(cfg, "/segments/SEGMENT/users?format=csv", "")
+	if lines := strings.Split(strings.TrimSpace(body), "\n"); status != http.StatusOK || len(lines) != 2 {
+		t.Fatalf("got %d %q, want csv with header and one member", status, body)
+	}
+	status, body = get(cfg, "/get_report?stream=true", report)
+	if status != http.StatusOK || !strings.Contains(body, "SEGMENT,"+db.OperationAdd) {
+		t.Fatalf("got %d %q, want report with addition of segment", status, body)
+	}
+	status, body = get(cfg, "/get_report", report)
+	if status != http.StatusOK || !strings.Contains(body, "/download_report/report_") {
+		t.Fatalf("got %d %q for report file, want download link", status, body)
+	}
+
+	cfg = config.Default()
+	cfg.StreamTimeout = time.Nanosecond
+	for _, target := range []string{"/segments/SEGMENT/users?format=csv", "/get_report?stream=true", "/get_report"} {
+		status, body = get(cfg, target, report)
+		if status != http.StatusServiceUnavailable {
+			t.Fatalf("%s: got %d %q, want %d", target, status, body, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+	_, err = database.CreateSegment(ctx, db.Segments{Slug: "SEGMENT"})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		handler httprouter.Handle
+		method  string
+		body    string
+		params  httprouter.Params
+		status  int
+		code    string
+	}{
+		{"bad user id", getUser(database), http.MethodGet, "", httprouter.Params{{Key: "id", Value: "bad"}}, http.StatusBadRequest, codeInvalidID},
+		{"unknown user", getUser(database), http.MethodGet, "", httprouter.Params{{Key: "id", Value: uuid.NewString()}}, http.StatusNotFound, codeNotFound},
+		{"delete unknown user", deleteUser(database), http.MethodDelete, "", httprouter.Params{{Key: "id", Value: uuid.NewString()}}, http.StatusNotFound, codeNotFound},
+		{"duplicate segment", createSegment(database), http.MethodPost, `{"slug": "SEGMENT"}`, nil, http.StatusConflict, codeAlreadyExists},
+		{"delete unknown segment", deleteSegment(database), http.MethodDelete, "", httprouter.Params{{Key: "slug", Value: "UNKNOWN"}}, http.StatusNotFound, codeNotFound},
+		{"add to unknown user", addSegmentsToUser(database), http.MethodPost, `{"user_id": "` + uuid.NewString() + `", "segments_to_add": {"SEGMENT": 1}}`, nil, http.StatusNotFound, codeNotFound},
+		{"add unknown segment", addSegmentsToUser(database), http.MethodPost, `{"user_id": "` + userIds[0].String() + `", "segments_to_add": {"UNKNOWN": 1}}`, nil, http.StatusUnprocessableEntity, codeValidation},
+		{"negative ttl", addSegmentsToUser(database), http.MethodPost, `{"user_id": "` + userIds[0].String() + `", "segments_to_add": {"SEGMENT": -1}}`, nil, http.StatusUnprocessableEntity, codeValidation},
+		{"malformed body", addSegmentsToUser(database), http.MethodPost, `{`, nil, http.StatusBadRequest, codeInvalidJSON},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+		recorder := httptest.NewRecorder()
+		test.handler(recorder, request, test.params)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, recorder.Code, test.status, recorder.Body)
+		}
+		problem := decodeProblem(t, recorder)
+		if problem.Code != test.code || problem.Status != test.status {
+			t.Errorf("%s: got problem %+v, want code %s", test.name, problem, test.code)
+		}
+	}
+}
+
+func TestInternalProblemsHideDetails(t *testing.T) {
+	for name, handler := range map[string]http.Handler{
+		"error": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, r, "Users fetching error", errors.New(`relation "users" does not exist`))
+		}),
+		"panic": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panicHandler(w, r, `relation "users" does not exist`)
+		}),
+	} {
+		recorder := httptest.NewRecorder()
+		withRequestID(handler).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/users", nil))
+		problem := decodeProblem(t, recorder)
+		if problem.Status != http.StatusInternalServerError || problem.Code != codeInternal || problem.RequestID == "" {
+			t.Fatalf("%s: got problem %+v, want internal error with request id", name, problem)
+		}
+		if strings.Contains(problem.Detail, "relation") {
+			t.Fatalf("%s: problem detail %q exposes internal error", name, problem.Detail)
+		}
+	}
+}
+
+func TestClientProblemsHideDriverErrors(t *testing.T) {
+	err := &db.Error{
+		Kind:    db.ErrAlreadyExists,
+		Message: "segment of user already exists",
+		Err:     errors.New(`ERROR #23505 duplicate key value violates unique constraint "idx_user_segment"`),
+	}
+	recorder := httptest.NewRecorder()
+	writeError(recorder, httptest.NewRequest(http.MethodPost, "/user_segments", nil), "User segments updating error", err)
+	problem := decodeProblem(t, recorder)
+	if problem.Status != http.StatusConflict || problem.Detail != "User segments updating error: segment of user already exists" {
+		t.Fatalf("got problem %+v, want conflict with message of db error only", problem)
+	}
+}
+
+func TestProblemListsEveryUnknownSegment(t *testing.T) {
+	ctx := context.Background()
+	database := db.NewService(db.NewMemory())
+	_, err := database.CreateUser(ctx, db.Users{Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+
+	body := `{"user_id": "` + userIds[0].String() + `", "segments_to_add": {"B": 1, "A": 1}, "segment_to_delete": ["C"]}`
+	request := httptest.NewRequest(http.MethodPost, "/user_segments", strings.NewReader(body))
+	request.Header.Set("X-Request-Id", "request-1")
+	recorder := httptest.NewRecorder()
+	handler := withRequestID(httprouterHandler(addSegmentsToUser(database)))
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get("X-Request-Id") != "request-1" {
+		t.Fatalf("got request id header %q", recorder.Header().Get("X-Request-Id"))
+	}
+	problem := decodeProblem(t, recorder)
+	if problem.RequestID != "request-1" || problem.Instance != "/user_segments" {
+		t.Fatalf("got problem %+v", problem)
+	}
+	var got []string
+	for _, fieldError := range problem.Errors {
+		got = append(got, fieldError.Field+":"+fieldError.Value)
+	}
+	if strings.Join(got, ",") != "segment_to_delete:C,segments_to_add:A,segments_to_add:B" {
+		t.Fatalf("got field errors %v", got)
+	}
+}
+
+func TestRouterProblems(t *testing.T) {
+	router := httprouter.New()
+	router.NotFound = notFoundHandler()
+	router.MethodNotAllowed = methodNotAllowedHandler()
+	router.GET("/users", getUsers(db.NewService(db.NewMemory())))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if problem := decodeProblem(t, recorder); problem.Code != codeNotFound {
+		t.Fatalf("got problem %+v, want %s", problem, codeNotFound)
+	}
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPatch, "/users", nil))
+	if problem := decodeProblem(t, recorder); problem.Code != codeMethodNotAllowed {
+		t.Fatalf("got problem %+v, want %s", problem, codeMethodNotAllowed)
+	}
+}
+
+func httprouterHandler(handle httprouter.Handle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, nil)
+	})
+}
+
+func decodeProblem(t *testing.T, recorder *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Fatalf("got content type %q, want application/problem+json", contentType)
+	}
+	var problem Problem
+	err := json.NewDecoder(recorder.Body).Decode(&problem)
+	if err != nil {
+		t.Fatalf("problem decoding: %v", err)
+	}
+	return problem
+}
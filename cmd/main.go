@@ -4,81 +4,182 @@ import (
 	"context"
 	"github.com/go-pg/pg/v10"
 	"github.com/julienschmidt/httprouter"
+	"github.com/nazarovlex/AVITO_TASK/internal/config"
 	"github.com/nazarovlex/AVITO_TASK/internal/db"
 	"github.com/nazarovlex/AVITO_TASK/internal/runner"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	var pgConn *pg.DB
-	opts := &pg.Options{
-		User:     "postgres",
-		Password: "postgres",
-		Addr:     "postgres:5432",
-		Database: "test_api",
+	cfg, command, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal("Config loading error: ", err)
 	}
+	log.Println("Config:", cfg)
 
-	pgConn = pg.Connect(opts)
+	opts, err := cfg.PgOptions()
+	if err != nil {
+		log.Fatal("Config loading error: ", err)
+	}
+	pgConn := pg.Connect(opts)
 	sql := db.NewSql(pgConn)
 	dbService := db.NewService(sql)
+	dbService.SetAliasTTL(cfg.SegmentAliasTTL)
+	reportLocation, err := cfg.ReportLocation()
+	if err != nil {
+		log.Fatal("Config loading error: ", err)
+	}
+	dbService.SetReportLocation(reportLocation)
 	log.Println("Successful connection to DB")
 
-	ctx := context.Background()
+	// ctx is cancelled on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// create Enum type for user_segment_history.operation field
-	err := dbService.CreateEnumType(ctx)
+	migrator, err := db.NewMigrator(pgConn)
 	if err != nil {
-		log.Fatal("Creating ENUM type error: ", err)
-	} else {
-		log.Println("ENUM type created")
+		log.Fatal("Loading migrations error: ", err)
+	}
+
+	if len(command) > 0 {
+		err = runCommand(ctx, migrator, command)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// create all db schemas
-	err = db.CreateSchema(ctx, dbService)
+	// apply pending migrations and refuse to start on schema which doesn't match the binary
+	if cfg.AutoMigrate {
+		err = migrator.Up(ctx)
+		if err != nil {
+			log.Fatal("Applying migrations error: ", err)
+		}
+	}
+	err = migrator.Check(ctx)
 	if err != nil {
-		log.Fatal("Create DB schemas error: ", err)
+		log.Fatal("DB schema check error: ", err)
 	} else {
-		log.Println("DB schemas created")
+		log.Println("DB schema is up to date")
 	}
 
-	// create db indexes
-	err = dbService.CreateIndexes(ctx)
+	err = os.MkdirAll(cfg.ReportsDir, 0o755)
 	if err != nil {
-		log.Fatal("Create DB indexes error: ", err)
-	} else {
-		log.Println("DB indexes created")
+		log.Fatal("Creating reports dir error: ", err)
 	}
 
-	go runner.Runner(ctx, dbService)
+	leadership := db.NewAdvisoryLeader(pgConn)
+	runnerDone := make(chan struct{})
+	go func() {
+		runner.Runner(ctx, dbService, leadership, cfg.RunnerInterval)
+		close(runnerDone)
+	}()
+
+	err = serve(ctx, dbService, leadership, cfg)
+	if err != nil {
+		log.Println("Server error: ", err)
+	}
 
-	serve(ctx, dbService)
+	// wait for runner to finish current iteration before closing connections
+	stop()
+	<-runnerDone
+	err = pgConn.Close()
+	if err != nil {
+		log.Println("Closing DB connection error: ", err)
+	}
+	log.Println("Server stopped")
 }
 
-func serve(ctx context.Context, dbService *db.Service) {
+// serve handles requests until ctx is cancelled, then waits for in-flight requests to finish
+func serve(ctx context.Context, dbService *db.Service, leadership runner.Leadership, cfg config.Config) error {
+	server := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: newHandler(dbService, leadership, cfg),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server listen and serve on", cfg.ListenAddr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// newHandler builds router of all routes wrapped in request middlewares
+func newHandler(dbService *db.Service, leadership runner.Leadership, cfg config.Config) http.Handler {
 	router := httprouter.New()
+	router.NotFound = notFoundHandler()
+	router.MethodNotAllowed = methodNotAllowedHandler()
+	router.PanicHandler = panicHandler
+
+	// exports of large segments and reports may last much longer than usual requests
+	request := func(handle httprouter.Handle) httprouter.Handle {
+		return withTimeout(handle, cfg.RequestTimeout)
+	}
+	export := func(handle httprouter.Handle) httprouter.Handle {
+		return withTimeout(handle, cfg.StreamTimeout)
+	}
 
 	// users routes
-	router.GET("/users", getUsers(ctx, dbService))
-	router.GET("/users/:id", getUser(ctx, dbService))
-	router.POST("/users", createUser(ctx, dbService))
-	router.DELETE("/users/:id", deleteUser(ctx, dbService))
+	router.GET("/users", request(getUsers(dbService)))
+	router.GET("/users/:id", request(getUser(dbService)))
+	router.GET("/users/:id/segments", request(getUserSegmentsAt(dbService)))
+	router.GET("/users/:id/history", request(getUserHistory(dbService)))
+	router.POST("/users", request(createUser(dbService)))
+	router.DELETE("/users/:id", request(deleteUser(dbService)))
 
 	// slugs routes
-	router.POST("/segments", createSegment(ctx, dbService))
-	router.DELETE("/segments/:slug", deleteSegment(ctx, dbService))
-	router.PUT("/segments/:slug", updateSegment(ctx, dbService))
+	router.GET("/segments", request(getSegments(dbService)))
+	router.GET("/segments/:slug", request(getSegment(dbService)))
+	router.GET("/segments/:slug/users", export(getSegmentMembers(dbService)))
+	router.POST("/segments", request(createSegment(dbService)))
+	router.DELETE("/segments/:slug", request(deleteSegment(dbService)))
+	router.PUT("/segments/:slug", request(updateSegment(dbService)))
+	router.POST("/segments/:slug/restore", request(restoreSegment(dbService)))
 
 	// add and delete user slugs route
-	router.POST("/user_segments", addSegmentsToUser(ctx, dbService))
+	router.POST("/user_segments", request(addSegmentsToUser(dbService)))
 
 	// reports save and download
-	router.GET("/get_report", createReport(ctx, dbService))
-	router.GET("/download_report/:filename", downloadReport)
+	router.GET("/get_report", export(createReport(dbService, cfg.ReportsDir, cfg.PublicURL)))
+	router.GET("/download_report/:filename", export(downloadReport(cfg.ReportsDir)))
 
-	log.Println("Server listen and serve on port :8000")
-	err := http.ListenAndServe(":8000", router)
-	if err != nil {
-		log.Fatal(err)
+	// background runner status
+	router.GET("/runner/leader", request(getRunnerLeader(leadership, cfg.InstanceID)))
+
+	return withRequestID(withActor(router))
+}
+
+// withTimeout limits time of the route, deadline is propagated to db queries through request context
+func withTimeout(handle httprouter.Handle, timeout time.Duration) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, routerParams httprouter.Params) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handle(w, r.WithContext(ctx), routerParams)
 	}
 }
+
+// withActor records changes of the request in history as made by actor from X-Actor header
+func withActor(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if actor := r.Header.Get("X-Actor"); actor != "" {
+			r = r.WithContext(db.WithActor(r.Context(), actor))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
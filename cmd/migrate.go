@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs cli command passed after flags, e.g. `migrate up`
+func runCommand(ctx context.Context, migrator *db.Migrator, command []string) error {
+	if len(command) != 2 || command[0] != "migrate" {
+		return fmt.Errorf("unknown command %v, usage: migrate up|down|status", command)
+	}
+
+	switch command[1] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return printMigrationStatus(statuses)
+	}
+	return errors.New("unknown migrate command " + command[1] + ", usage: migrate up|down|status")
+}
+
+func printMigrationStatus(statuses []db.MigrationStatus) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, err := fmt.Fprintln(writer, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		state := "pending"
+		appliedAt := ""
+		if status.Applied {
+			state = "applied"
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		if status.Unknown {
+			state = "unknown to binary"
+		}
+		_, err = fmt.Fprintf(writer, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
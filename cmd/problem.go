@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"log"
+	"net/http"
+)
+
+// machine readable error codes
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidID        = "invalid_id"
+	codeInvalidQuery     = "invalid_query"
+	codeValidation       = "validation_error"
+	codeNotFound         = "not_found"
+	codeAlreadyExists    = "already_exists"
+	codeConflict         = "conflict"
+	codeTimeout          = "timeout"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInternal         = "internal_error"
+)
+
+// Problem is RFC 7807 problem details body used for every error response
+type Problem struct {
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Status    int             `json:"status"`
+	Code      string          `json:"code"`
+	Detail    string          `json:"detail"`
+	Instance  string          `json:"instance,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Errors    []db.FieldError `json:"errors,omitempty"`
+}
+
+type requestIdKey struct{}
+
+// withRequestID takes request id from X-Request-Id header or generates new one and returns it in response header
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" {
+			requestId = uuid.NewString()
+		}
+		w.Header().Set("X-Request-Id", requestId)
+		ctx := context.WithValue(r.Context(), requestIdKey{}, requestId)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestID(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// writeProblem replies with problem, detail of 5xx problems is only logged and client gets generic detail
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string, fieldErrors ...db.FieldError) {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r.Context()),
+		Errors:    fieldErrors,
+	}
+	if status >= http.StatusInternalServerError {
+		log.Printf("Request %s %s %s error: %s\n", problem.RequestID, r.Method, r.URL.Path, detail)
+		problem.Detail = "Internal server error"
+		if code == codeTimeout {
+			problem.Detail = "Request timed out"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(problem)
+	if err != nil {
+		log.Printf("Request %s problem encoding error: %v\n", problem.RequestID, err)
+	}
+}
+
+// writeError replies with problem matching kind of db error, unknown errors are internal.
+// Client problem of db error gets only its message, wrapped driver error is logged
+func writeError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	status := http.StatusInternalServerError
+	code := codeInternal
+	switch {
+	case errors.Is(err, db.ErrValidation):
+		status, code = http.StatusUnprocessableEntity, codeValidation
+	case errors.Is(err, db.ErrNotFound):
+		status, code = http.StatusNotFound, codeNotFound
+	case errors.Is(err, db.ErrAlreadyExists):
+		status, code = http.StatusConflict, codeAlreadyExists
+	case errors.Is(err, db.ErrConflict):
+		status, code = http.StatusConflict, codeConflict
+	case errors.Is(err, context.DeadlineExceeded):
+		status, code = http.StatusServiceUnavailable, codeTimeout
+	}
+
+	detail := fmt.Sprintf("%s: %v", message, err)
+	var details []db.FieldError
+	var domainErr *db.Error
+	if errors.As(err, &domainErr) && status < http.StatusInternalServerError {
+		details = domainErr.Details
+		if domainErr.Err != nil {
+			log.Printf("Request %s %s %s error: %s\n", requestID(r.Context()), r.Method, r.URL.Path, detail)
+		}
+		detail = fmt.Sprintf("%s: %s", message, domainErr.Message)
+	}
+	writeProblem(w, r, status, code, detail, details...)
+}
+
+func writeInvalidJSON(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, fmt.Sprintf("Invalid request data: %v", err))
+}
+
+func writeInvalidID(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, http.StatusBadRequest, codeInvalidID, fmt.Sprintf("UUID parse error: %v", err), db.FieldError{
+		Field:   "id",
+		Message: "must be UUID",
+	})
+}
+
+func notFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "Route not found")
+	})
+}
+
+func methodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	})
+}
+
+func panicHandler(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+	if recovered == http.ErrAbortHandler {
+		// streaming handler gave up on partially sent response, net/http closes the connection
+		panic(recovered)
+	}
+	writeProblem(w, r, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Panic: %v", recovered))
+}
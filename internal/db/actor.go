@@ -0,0 +1,19 @@
+package db
+
+import "context"
+
+// ActorSystem is actor of changes made by the service itself: rollout enrollment and ttl expiration
+const ActorSystem = "system"
+
+type actorKey struct{}
+
+// WithActor returns context which changes are recorded in history as made by actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom returns actor of the context, empty if it is unknown
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
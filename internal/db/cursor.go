@@ -0,0 +1,39 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Cursor points to the last row of previous page for keyset pagination, clients get it as opaque string
+type Cursor struct {
+	// ID is unique id of the row
+	ID string `json:"id"`
+	// Key is value of sort column if rows are not sorted by id
+	Key string `json:"key,omitempty"`
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses cursor string, empty string means first page
+func DecodeCursor(cursor string) (Cursor, error) {
+	var decoded Cursor
+	if cursor == "" {
+		return decoded, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &decoded)
+	}
+	if err != nil || decoded.ID == "" {
+		return Cursor{}, &Error{
+			Kind:    ErrValidation,
+			Message: "invalid cursor",
+			Details: []FieldError{{Field: "cursor", Value: cursor, Message: "malformed cursor"}},
+		}
+	}
+	return decoded, nil
+}
@@ -0,0 +1,1522 @@
+// Package dbtest contains conformance suite which every db.Database implementation must pass
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Factory returns empty database for single test
+type Factory func(t *testing.T) db.Database
+
+// Run runs conformance suite against databases created by newDatabase
+func Run(t *testing.T, newDatabase Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, database db.Database)
+	}{
+		{"CreateAndFetchUser", testCreateAndFetchUser},
+		{"CreateDuplicateUser", testCreateDuplicateUser},
+		{"FetchUnknownUser", testFetchUnknownUser},
+		{"UserExternalID", testUserExternalID},
+		{"DeleteUser", testDeleteUser},
+		{"RecreateDeletedUser", testRecreateDeletedUser},
+		{"EraseUser", testEraseUser},
+		{"ForeignKeys", testForeignKeys},
+		{"FetchUsers", testFetchUsers},
+		{"FetchUsersFilter", testFetchUsersFilter},
+		{"CreateAndFetchSegment", testCreateAndFetchSegment},
+		{"CreateDuplicateSegment", testCreateDuplicateSegment},
+		{"FetchSegments", testFetchSegments},
+		{"FetchSegmentMembers", testFetchSegmentMembers},
+		{"SegmentMetadata", testSegmentMetadata},
+		{"FetchRolloutSegments", testFetchRolloutSegments},
+		{"UpdateSegment", testUpdateSegment},
+		{"ArchiveSegment", testArchiveSegment},
+		{"RemoveSegmentAssignments", testRemoveSegmentAssignments},
+		{"EnrollRollout", testEnrollRollout},
+		{"DeleteSegment", testDeleteSegment},
+		{"SegmentAliases", testSegmentAliases},
+		{"UserSegments", testUserSegments},
+		{"DuplicateUserSegment", testDuplicateUserSegment},
+		{"DropExpiredSegments", testDropExpiredSegments},
+		{"DropExpiredSegmentsBatch", testDropExpiredSegmentsBatch},
+		{"ExpiredSegmentsAreHidden", testExpiredSegmentsAreHidden},
+		{"DropExpiredUserSegments", testDropExpiredUserSegments},
+		{"NextExpiration", testNextExpiration},
+		{"GetHistory", testGetHistory},
+		{"GetHistoryFilter", testGetHistoryFilter},
+		{"StreamHistory", testStreamHistory},
+		{"FetchUserSegmentsAt", testFetchUserSegmentsAt},
+		{"FetchUserHistory", testFetchUserHistory},
+		{"TransactionCommit", testTransactionCommit},
+		{"TransactionRollback", testTransactionRollback},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newDatabase(t))
+		})
+	}
+}
+
+func createUser(t *testing.T, database db.Database) db.Users {
+	t.Helper()
+	user := db.Users{
+		ID:   uuid.New(),
+		Name: "user",
+	}
+	created, err := database.CreateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created != user {
+		t.Fatalf("CreateUser returned %+v, want %+v", created, user)
+	}
+	return created
+}
+
+func userExists(t *testing.T, database db.Database, userId uuid.UUID) bool {
+	t.Helper()
+	exists, err := database.CheckExistedUser(context.Background(), userId)
+	if err != nil {
+		t.Fatalf("CheckExistedUser: %v", err)
+	}
+	return exists
+}
+
+func createSegment(t *testing.T, database db.Database, slug string, percent int) db.Segments {
+	t.Helper()
+	segment := db.Segments{
+		ID:      uuid.New(),
+		Slug:    slug,
+		Percent: percent,
+		Salt:    uuid.New().String(),
+	}
+	created, err := database.CreateSegment(context.Background(), segment)
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	if created.ID != segment.ID || created.Slug != segment.Slug || created.Percent != segment.Percent || created.Salt != segment.Salt {
+		t.Fatalf("CreateSegment returned %+v, want %+v", created, segment)
+	}
+	if created.CreatedAt.IsZero() {
+		t.Fatal("CreateSegment returned segment without creation time")
+	}
+	return created
+}
+
+func addUserSegment(t *testing.T, database db.Database, userId, segmentId uuid.UUID, expirationTime time.Time) {
+	t.Helper()
+	err := database.AddUserSegments(context.Background(), userId, segmentId, expirationTime)
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+}
+
+func fetchSlugs(t *testing.T, database db.Database, userId uuid.UUID) []string {
+	t.Helper()
+	user, err := database.FetchUser(context.Background(), userId)
+	if err != nil {
+		t.Fatalf("FetchUser: %v", err)
+	}
+	if user.UserID != userId {
+		t.Fatalf("FetchUser returned user %v, want %v", user.UserID, userId)
+	}
+	return user.SegmentSlugs
+}
+
+func assertSlugs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	sorted := append([]string{}, got...)
+	sort.Strings(sorted)
+	if len(sorted) != len(want) {
+		t.Fatalf("got slugs %v, want %v", got, want)
+	}
+	for i := range want {
+		if sorted[i] != want[i] {
+			t.Fatalf("got slugs %v, want %v", got, want)
+		}
+	}
+}
+
+// monthFilter selects history of the month in UTC
+func monthFilter(year, month int) db.HistoryFilter {
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return db.HistoryFilter{From: from, To: from.AddDate(0, 1, 0)}
+}
+
+func assertErrorKind(t *testing.T, err error, kind error) {
+	t.Helper()
+	if !errors.Is(err, kind) {
+		t.Fatalf("got error %v, want %v", err, kind)
+	}
+}
+
+func testCreateAndFetchUser(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+
+	if !userExists(t, database, user.ID) {
+		t.Fatal("CheckExistedUser returned false for created user")
+	}
+	if userExists(t, database, uuid.New()) {
+		t.Fatal("CheckExistedUser returned true for unknown user")
+	}
+	assertSlugs(t, fetchSlugs(t, database, user.ID))
+
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+	if len(userIds) != 1 || userIds[0] != user.ID {
+		t.Fatalf("FetchUserIDs returned %v, want [%v]", userIds, user.ID)
+	}
+}
+
+func testCreateDuplicateUser(t *testing.T, database db.Database) {
+	user := createUser(t, database)
+	_, err := database.CreateUser(context.Background(), user)
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testFetchUnknownUser(t *testing.T, database db.Database) {
+	_, err := database.FetchUser(context.Background(), uuid.New())
+	assertErrorKind(t, err, db.ErrNotFound)
+}
+
+func testUserExternalID(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	// users without external id don't conflict with each other
+	createUser(t, database)
+	createUser(t, database)
+
+	user := db.Users{ID: uuid.New(), Name: "user", ExternalID: "account-1"}
+	created, err := database.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created != user {
+		t.Fatalf("CreateUser returned %+v, want %+v", created, user)
+	}
+
+	fetched, err := database.FetchUserByExternalID(ctx, "account-1")
+	if err != nil {
+		t.Fatalf("FetchUserByExternalID: %v", err)
+	}
+	if fetched != user {
+		t.Fatalf("FetchUserByExternalID returned %+v, want %+v", fetched, user)
+	}
+	withSegments, err := database.FetchUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("FetchUser: %v", err)
+	}
+	if withSegments.ExternalID != "account-1" {
+		t.Fatalf("FetchUser returned external id %q, want account-1", withSegments.ExternalID)
+	}
+
+	_, err = database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "other", ExternalID: "account-1"})
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+
+	_, err = database.FetchUserByExternalID(ctx, "unknown")
+	assertErrorKind(t, err, db.ErrNotFound)
+}
+
+func testDeleteUser(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user, err := database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "user", ExternalID: "account-1"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	segment := createSegment(t, database, "SEGMENT", 0)
+
+	err = database.DeleteUser(ctx, user.ID, time.Now())
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if userExists(t, database, user.ID) {
+		t.Fatal("deleted user still exists")
+	}
+	_, err = database.FetchUser(ctx, user.ID)
+	assertErrorKind(t, err, db.ErrNotFound)
+	_, err = database.FetchUserByExternalID(ctx, "account-1")
+	assertErrorKind(t, err, db.ErrNotFound)
+	users, err := database.FetchUsers(ctx, db.UsersFilter{})
+	if err != nil {
+		t.Fatalf("FetchUsers: %v", err)
+	}
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+	if len(users) != 0 || len(userIds) != 0 {
+		t.Fatalf("FetchUsers returned %+v and FetchUserIDs returned %v, want no deleted users", users, userIds)
+	}
+	err = database.DeleteUser(ctx, user.ID, time.Now())
+	assertErrorKind(t, err, db.ErrNotFound)
+
+	// deleted user keeps its id and can still be referenced by history
+	_, err = database.CreateUser(ctx, db.Users{ID: user.ID, Name: "user"})
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+	err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationDelete, OperationAt: time.Now()})
+	if err != nil {
+		t.Fatalf("SaveHistory: %v", err)
+	}
+}
+
+func testRecreateDeletedUser(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	deleted, err := database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "user", ExternalID: "account-1"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	err = database.DeleteUser(ctx, deleted.ID, time.Now())
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	// external id of deleted user is free for new user
+	user := db.Users{ID: uuid.New(), Name: "new user", ExternalID: "account-1"}
+	_, err = database.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("CreateUser with external id of deleted user: %v", err)
+	}
+	fetched, err := database.FetchUserByExternalID(ctx, "account-1")
+	if err != nil {
+		t.Fatalf("FetchUserByExternalID: %v", err)
+	}
+	if fetched != user {
+		t.Fatalf("FetchUserByExternalID returned %+v, want %+v", fetched, user)
+	}
+	if userExists(t, database, deleted.ID) || !userExists(t, database, user.ID) {
+		t.Fatal("CheckExistedUser doesn't tell deleted user from new one")
+	}
+
+	// external id stays unique among not deleted users
+	_, err = database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "other", ExternalID: "account-1"})
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testEraseUser(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user, err := database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "user", ExternalID: "account-1"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	other := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	addUserSegment(t, database, user.ID, segment.ID, time.Time{})
+	addUserSegment(t, database, other.ID, segment.ID, time.Time{})
+	operatedAt := time.Now().Truncate(time.Millisecond)
+	for _, userId := range []uuid.UUID{user.ID, other.ID} {
+		err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: userId, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: operatedAt})
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	err = database.EraseUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("EraseUser: %v", err)
+	}
+	members, err := database.FetchSegmentMembers(ctx, segment.ID, uuid.Nil, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(members) != 1 || members[0].UserID != other.ID {
+		t.Fatalf("FetchSegmentMembers returned %+v, want only %s", members, other.ID)
+	}
+	entries, err := database.GetHistory(ctx, monthFilter(operatedAt.UTC().Year(), int(operatedAt.UTC().Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	var anonymous, kept int
+	for _, entry := range entries {
+		switch entry.UserID {
+		case uuid.Nil:
+			anonymous++
+		case other.ID:
+			kept++
+		}
+	}
+	if len(entries) != 2 || anonymous != 1 || kept != 1 {
+		t.Fatalf("GetHistory returned %+v, want anonymous entry of erased user and entry of other user", entries)
+	}
+
+	// erased user frees its ids, deleted user can be erased too
+	_, err = database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "user", ExternalID: "account-1"})
+	if err != nil {
+		t.Fatalf("CreateUser with external id of erased user: %v", err)
+	}
+	err = database.EraseUser(ctx, user.ID)
+	assertErrorKind(t, err, db.ErrNotFound)
+	err = database.DeleteUser(ctx, other.ID, time.Now())
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	err = database.EraseUser(ctx, other.ID)
+	if err != nil {
+		t.Fatalf("EraseUser of deleted user: %v", err)
+	}
+}
+
+func testForeignKeys(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+
+	err := database.AddUserSegments(ctx, uuid.New(), segment.ID, time.Time{})
+	assertErrorKind(t, err, db.ErrConflict)
+	err = database.AddUserSegments(ctx, user.ID, uuid.New(), time.Time{})
+	assertErrorKind(t, err, db.ErrConflict)
+	err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: uuid.New(), SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: time.Now()})
+	assertErrorKind(t, err, db.ErrConflict)
+	err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: uuid.New(), Operation: db.OperationAdd, OperationAt: time.Now()})
+	assertErrorKind(t, err, db.ErrConflict)
+}
+
+func testFetchUsers(t *testing.T, database db.Database) {
+	first := createUser(t, database)
+	second := createUser(t, database)
+	segmentA := createSegment(t, database, "SEGMENT_A", 0)
+	segmentB := createSegment(t, database, "SEGMENT_B", 0)
+	addUserSegment(t, database, first.ID, segmentB.ID, time.Time{})
+	addUserSegment(t, database, first.ID, segmentA.ID, time.Time{})
+
+	users, err := database.FetchUsers(context.Background(), db.UsersFilter{})
+	if err != nil {
+		t.Fatalf("FetchUsers: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("FetchUsers returned %d users, want 2", len(users))
+	}
+	for _, user := range users {
+		switch user.UserID {
+		case first.ID:
+			assertSlugs(t, user.SegmentSlugs, "SEGMENT_A", "SEGMENT_B")
+		case second.ID:
+			assertSlugs(t, user.SegmentSlugs)
+		default:
+			t.Fatalf("FetchUsers returned unknown user %v", user.UserID)
+		}
+	}
+}
+
+func testFetchUsersFilter(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	names := []string{"bob", "alice", "albert", "al_x", "carol"}
+	users := map[string]db.Users{}
+	for _, name := range names {
+		user, err := database.CreateUser(ctx, db.Users{ID: uuid.New(), Name: name})
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		users[name] = user
+	}
+	segment := createSegment(t, database, "SEGMENT", 0)
+	expired := createSegment(t, database, "EXPIRED", 0)
+	addUserSegment(t, database, users["alice"].ID, segment.ID, time.Time{})
+	addUserSegment(t, database, users["carol"].ID, segment.ID, time.Now().Add(time.Hour))
+	addUserSegment(t, database, users["bob"].ID, expired.ID, time.Now().Add(-time.Hour))
+
+	fetchNames := func(filter db.UsersFilter) []string {
+		t.Helper()
+		fetched, err := database.FetchUsers(ctx, filter)
+		if err != nil {
+			t.Fatalf("FetchUsers(%+v): %v", filter, err)
+		}
+		got := []string{}
+		for _, user := range fetched {
+			got = append(got, user.Name)
+		}
+		return got
+	}
+	assertNames := func(got []string, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got users %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got users %v, want %v", got, want)
+			}
+		}
+	}
+
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName}), "al_x", "albert", "alice", "bob", "carol")
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, Limit: 2}), "al_x", "albert")
+	albert := users["albert"]
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, Limit: 2, AfterID: albert.ID, AfterName: albert.Name}), "alice", "bob")
+	// LIKE wildcards in prefix are matched literally
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, NamePrefix: "al_"}), "al_x")
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, NamePrefix: "al"}), "al_x", "albert", "alice")
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, SegmentSlug: "SEGMENT"}), "alice", "carol")
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, SegmentSlug: "EXPIRED"}))
+	assertNames(fetchNames(db.UsersFilter{Sort: db.UsersSortName, NoSegments: true}), "al_x", "albert", "bob")
+
+	// pages sorted by id cover every user exactly once
+	seen := map[uuid.UUID]bool{}
+	filter := db.UsersFilter{Limit: 2}
+	for {
+		page, err := database.FetchUsers(ctx, filter)
+		if err != nil {
+			t.Fatalf("FetchUsers: %v", err)
+		}
+		for i, user := range page {
+			if seen[user.UserID] {
+				t.Fatalf("user %v returned twice", user.UserID)
+			}
+			if i > 0 && page[i-1].UserID.String() >= user.UserID.String() {
+				t.Fatalf("users are not sorted by id: %v", page)
+			}
+			seen[user.UserID] = true
+		}
+		if len(page) < filter.Limit {
+			break
+		}
+		filter.AfterID = page[len(page)-1].UserID
+	}
+	if len(seen) != len(names) {
+		t.Fatalf("pages returned %d users, want %d", len(seen), len(names))
+	}
+}
+
+func testCreateAndFetchSegment(t *testing.T, database db.Database) {
+	created := createSegment(t, database, "SEGMENT", 30)
+
+	segment, err := database.FetchSegment(context.Background(), "SEGMENT")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if segment.ID != created.ID || segment.Slug != created.Slug || segment.Percent != created.Percent || segment.Salt != created.Salt {
+		t.Fatalf("FetchSegment returned %+v, want %+v", segment, created)
+	}
+
+	_, err = database.FetchSegment(context.Background(), "UNKNOWN")
+	assertErrorKind(t, err, db.ErrNotFound)
+}
+
+func testCreateDuplicateSegment(t *testing.T, database db.Database) {
+	createSegment(t, database, "SEGMENT", 0)
+	_, err := database.CreateSegment(context.Background(), db.Segments{ID: uuid.New(), Slug: "SEGMENT"})
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testFetchSegments(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	first := createUser(t, database)
+	second := createUser(t, database)
+	voice := createSegment(t, database, "AVITO_VOICE_MESSAGES", 30)
+	createSegment(t, database, "AVITO_DISCOUNT_30", 0)
+	createSegment(t, database, "PERFORMANCE", 0)
+	addUserSegment(t, database, first.ID, voice.ID, time.Time{})
+	addUserSegment(t, database, second.ID, voice.ID, time.Now().Add(-time.Hour))
+
+	details, err := database.FetchSegmentDetails(ctx, "AVITO_VOICE_MESSAGES")
+	if err != nil {
+		t.Fatalf("FetchSegmentDetails: %v", err)
+	}
+	// expired assignment is not counted
+	if details.ID != voice.ID || details.Percent != 30 || details.MemberCount != 1 || details.CreatedAt.IsZero() {
+		t.Fatalf("FetchSegmentDetails returned %+v, want %+v with 1 member", details, voice)
+	}
+	_, err = database.FetchSegmentDetails(ctx, "UNKNOWN")
+	assertErrorKind(t, err, db.ErrNotFound)
+
+	listSlugs := func(filter db.SegmentsFilter) []string {
+		t.Helper()
+		segments, err := database.FetchSegments(ctx, filter)
+		if err != nil {
+			t.Fatalf("FetchSegments(%+v): %v", filter, err)
+		}
+		slugs := []string{}
+		for _, segment := range segments {
+			slugs = append(slugs, segment.Slug)
+		}
+		return slugs
+	}
+	assertOrdered := func(got []string, want ...string) {
+		t.Helper()
+		assertSlugs(t, got, want...)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("got slugs %v, want %v", got, want)
+			}
+		}
+	}
+	assertOrdered(listSlugs(db.SegmentsFilter{}), "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES", "PERFORMANCE")
+	assertOrdered(listSlugs(db.SegmentsFilter{Limit: 1, AfterSlug: "AVITO_DISCOUNT_30"}), "AVITO_VOICE_MESSAGES")
+	assertOrdered(listSlugs(db.SegmentsFilter{Search: "avito"}), "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES")
+	// LIKE wildcards in search are matched literally
+	assertOrdered(listSlugs(db.SegmentsFilter{Search: "_30"}), "AVITO_DISCOUNT_30")
+	assertOrdered(listSlugs(db.SegmentsFilter{Search: "%"}))
+}
+
+func testFetchSegmentMembers(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	segment := createSegment(t, database, "SEGMENT", 0)
+	other := createSegment(t, database, "OTHER", 0)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	var members []db.Users
+	for i := 0; i < 3; i++ {
+		user := createUser(t, database)
+		addUserSegment(t, database, user.ID, segment.ID, expiresAt)
+		members = append(members, user)
+	}
+	expired := createUser(t, database)
+	addUserSegment(t, database, expired.ID, segment.ID, time.Now().Add(-time.Hour))
+	addUserSegment(t, database, expired.ID, other.ID, time.Time{})
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID.String() < members[j].ID.String()
+	})
+
+	page, err := database.FetchSegmentMembers(ctx, segment.ID, uuid.Nil, 2)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(page) != 2 || page[0].UserID != members[0].ID || page[1].UserID != members[1].ID {
+		t.Fatalf("FetchSegmentMembers returned %+v, want first 2 of %v", page, members)
+	}
+	if page[0].ExpiresAt == nil || !page[0].ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("member expires at %v, want %v", page[0].ExpiresAt, expiresAt)
+	}
+
+	page, err = database.FetchSegmentMembers(ctx, segment.ID, page[1].UserID, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(page) != 1 || page[0].UserID != members[2].ID {
+		t.Fatalf("FetchSegmentMembers returned %+v, want [%v]", page, members[2].ID)
+	}
+
+	page, err = database.FetchSegmentMembers(ctx, other.ID, uuid.Nil, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(page) != 1 || page[0].UserID != expired.ID || page[0].ExpiresAt != nil {
+		t.Fatalf("FetchSegmentMembers returned %+v, want [%v] without expiration", page, expired.ID)
+	}
+}
+
+func testSegmentMetadata(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment, err := database.CreateSegment(ctx, db.Segments{
+		ID:          uuid.New(),
+		Slug:        "VOICE",
+		Salt:        uuid.New().String(),
+		Description: "voice messages",
+		Owner:       "messenger",
+		Tags:        []string{"chat", "experiment"},
+	})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	createSegment(t, database, "OTHER", 0)
+
+	details, err := database.FetchSegmentDetails(ctx, "VOICE")
+	if err != nil {
+		t.Fatalf("FetchSegmentDetails: %v", err)
+	}
+	if details.Description != "voice messages" || details.Owner != "messenger" || strings.Join(details.Tags, ",") != "chat,experiment" {
+		t.Fatalf("FetchSegmentDetails returned %+v, want %+v", details, segment)
+	}
+	if details.CreatedAt.IsZero() || details.UpdatedAt.IsZero() {
+		t.Fatalf("FetchSegmentDetails returned %+v without timestamps", details)
+	}
+
+	for _, filter := range []db.SegmentsFilter{{Owner: "messenger"}, {Tag: "chat"}, {Owner: "messenger", Tag: "experiment"}} {
+		segments, err := database.FetchSegments(ctx, filter)
+		if err != nil {
+			t.Fatalf("FetchSegments(%+v): %v", filter, err)
+		}
+		if len(segments) != 1 || segments[0].ID != segment.ID {
+			t.Fatalf("FetchSegments(%+v) returned %+v, want [VOICE]", filter, segments)
+		}
+	}
+	segments, err := database.FetchSegments(ctx, db.SegmentsFilter{Tag: "unknown"})
+	if err != nil {
+		t.Fatalf("FetchSegments: %v", err)
+	}
+	if len(segments) != 0 {
+		t.Fatalf("FetchSegments returned %+v for unknown tag", segments)
+	}
+
+	updatedAt := details.UpdatedAt.Add(time.Hour)
+	err = database.UpdateSegment(ctx, db.Segments{ID: segment.ID, Slug: "VOICE", Owner: "platform", Tags: []string{}, UpdatedAt: updatedAt})
+	if err != nil {
+		t.Fatalf("UpdateSegment: %v", err)
+	}
+	details, err = database.FetchSegmentDetails(ctx, "VOICE")
+	if err != nil {
+		t.Fatalf("FetchSegmentDetails: %v", err)
+	}
+	if details.Description != "" || details.Owner != "platform" || len(details.Tags) != 0 || !details.UpdatedAt.Equal(updatedAt) {
+		t.Fatalf("updated segment is %+v", details)
+	}
+
+	operatedAt := time.Date(2023, time.August, 10, 12, 0, 0, 0, time.UTC)
+	err = database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: operatedAt})
+	if err != nil {
+		t.Fatalf("SaveHistory: %v", err)
+	}
+	entries, err := database.GetHistory(ctx, monthFilter(2023, 8))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Owner != "platform" || entries[0].Slug != "VOICE" {
+		t.Fatalf("GetHistory returned %+v, want entry with segment owner", entries)
+	}
+}
+
+func testFetchRolloutSegments(t *testing.T, database db.Database) {
+	createSegment(t, database, "MANUAL", 0)
+	rollout := createSegment(t, database, "ROLLOUT", 50)
+
+	segments, err := database.FetchRolloutSegments(context.Background())
+	if err != nil {
+		t.Fatalf("FetchRolloutSegments: %v", err)
+	}
+	if len(segments) != 1 || segments[0].ID != rollout.ID || segments[0].Salt != rollout.Salt {
+		t.Fatalf("FetchRolloutSegments returned %+v, want [%+v]", segments, rollout)
+	}
+}
+
+func testUpdateSegment(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	segment := createSegment(t, database, "OLD", 40)
+	createSegment(t, database, "TAKEN", 0)
+
+	err := database.UpdateSegment(ctx, db.Segments{ID: segment.ID, Slug: "NEW"})
+	if err != nil {
+		t.Fatalf("UpdateSegment: %v", err)
+	}
+	updated, err := database.FetchSegment(ctx, "NEW")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	// only slug is updated, rollout settings stay untouched
+	if updated.ID != segment.ID || updated.Percent != segment.Percent || updated.Salt != segment.Salt {
+		t.Fatalf("updated segment is %+v, want %+v with new slug", updated, segment)
+	}
+	_, err = database.FetchSegment(ctx, "OLD")
+	assertErrorKind(t, err, db.ErrNotFound)
+
+	err = database.UpdateSegment(ctx, db.Segments{ID: segment.ID, Slug: "TAKEN"})
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testSegmentAliases(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	segment := createSegment(t, database, "NEW", 0)
+	for _, alias := range []db.SegmentAliases{
+		{Slug: "OLD", SegmentID: segment.ID, ExpiresAt: time.Now().Add(time.Hour)},
+		{Slug: "EXPIRED", SegmentID: segment.ID, ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		err := database.SaveSegmentAlias(ctx, alias)
+		if err != nil {
+			t.Fatalf("SaveSegmentAlias: %v", err)
+		}
+	}
+
+	fetched, err := database.FetchSegment(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if fetched.ID != segment.ID || fetched.Slug != "NEW" {
+		t.Fatalf("FetchSegment by alias returned %+v, want %+v", fetched, segment)
+	}
+	details, err := database.FetchSegmentDetails(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("FetchSegmentDetails: %v", err)
+	}
+	if details.ID != segment.ID {
+		t.Fatalf("FetchSegmentDetails by alias returned %+v, want %+v", details, segment)
+	}
+	_, err = database.FetchSegment(ctx, "EXPIRED")
+	assertErrorKind(t, err, db.ErrNotFound)
+
+	// saving alias again moves it
+	other := createSegment(t, database, "OTHER", 0)
+	err = database.SaveSegmentAlias(ctx, db.SegmentAliases{Slug: "OLD", SegmentID: other.ID, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("SaveSegmentAlias: %v", err)
+	}
+	fetched, err = database.FetchSegment(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if fetched.ID != other.ID {
+		t.Fatalf("FetchSegment by moved alias returned %+v, want %+v", fetched, other)
+	}
+
+	err = database.DeleteSegmentAlias(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("DeleteSegmentAlias: %v", err)
+	}
+	_, err = database.FetchSegment(ctx, "OLD")
+	assertErrorKind(t, err, db.ErrNotFound)
+	err = database.DeleteSegmentAlias(ctx, "OLD")
+	if err != nil {
+		t.Fatalf("DeleteSegmentAlias of missing alias: %v", err)
+	}
+}
+
+func testArchiveSegment(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	segment := createSegment(t, database, "ROLLOUT", 50)
+	createSegment(t, database, "ACTIVE", 0)
+
+	archivedAt := time.Now().Truncate(time.Millisecond)
+	segment.ArchivedAt = &archivedAt
+	err := database.UpdateSegment(ctx, segment)
+	if err != nil {
+		t.Fatalf("UpdateSegment: %v", err)
+	}
+	archived, err := database.FetchSegment(ctx, "ROLLOUT")
+	if err != nil {
+		t.Fatalf("FetchSegment: %v", err)
+	}
+	if !archived.Archived() || !archived.ArchivedAt.Equal(archivedAt) {
+		t.Fatalf("archived segment is %+v, want archived at %v", archived, archivedAt)
+	}
+
+	rollout, err := database.FetchRolloutSegments(ctx)
+	if err != nil {
+		t.Fatalf("FetchRolloutSegments: %v", err)
+	}
+	if len(rollout) != 0 {
+		t.Fatalf("FetchRolloutSegments returned %+v, want no archived segments", rollout)
+	}
+	for _, test := range []struct {
+		archived bool
+		want     string
+	}{
+		{false, "ACTIVE"},
+		{true, "ROLLOUT"},
+	} {
+		segments, err := database.FetchSegments(ctx, db.SegmentsFilter{Archived: test.archived})
+		if err != nil {
+			t.Fatalf("FetchSegments: %v", err)
+		}
+		if len(segments) != 1 || segments[0].Slug != test.want || (segments[0].ArchivedAt != nil) != test.archived {
+			t.Fatalf("FetchSegments archived=%v returned %+v, want %s", test.archived, segments, test.want)
+		}
+	}
+
+	segment.ArchivedAt = nil
+	err = database.UpdateSegment(ctx, segment)
+	if err != nil {
+		t.Fatalf("UpdateSegment: %v", err)
+	}
+	details, err := database.FetchSegmentDetails(ctx, "ROLLOUT")
+	if err != nil {
+		t.Fatalf("FetchSegmentDetails: %v", err)
+	}
+	if details.ArchivedAt != nil {
+		t.Fatalf("restored segment is %+v, want not archived", details)
+	}
+}
+
+func testEnrollRollout(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	var want []uuid.UUID
+	for i := 0; i < 50; i++ {
+		user := createUser(t, database)
+		if i%10 == 0 {
+			err := database.DeleteUser(ctx, user.ID, time.Now())
+			if err != nil {
+				t.Fatalf("DeleteUser: %v", err)
+			}
+			continue
+		}
+		want = append(want, user.ID)
+	}
+	segment := createSegment(t, database, "SEGMENT", 50)
+	// storage computes the same buckets as RolloutBucket
+	inRollout := want[:0]
+	for _, userId := range want {
+		if segment.InRollout(userId) {
+			inRollout = append(inRollout, userId)
+		}
+	}
+	want = inRollout
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].String() < want[j].String()
+	})
+
+	operatedAt := time.Now().Truncate(time.Millisecond)
+	err := database.EnrollRollout(ctx, segment, operatedAt, db.ActorSystem)
+	if err != nil {
+		t.Fatalf("EnrollRollout: %v", err)
+	}
+	members, err := database.FetchSegmentMembers(ctx, segment.ID, uuid.Nil, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	got := []uuid.UUID{}
+	for _, member := range members {
+		if member.ExpiresAt != nil {
+			t.Fatalf("enrolled member %+v expires", member)
+		}
+		got = append(got, member.UserID)
+	}
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("EnrollRollout enrolled %v, want %v", got, want)
+	}
+
+	events, err := database.FetchUserHistory(ctx, want[0], db.UserHistoryFilter{})
+	if err != nil {
+		t.Fatalf("FetchUserHistory: %v", err)
+	}
+	if len(events) != 1 || events[0].Operation != db.OperationAdd || !events[0].OperationAt.Equal(operatedAt) || events[0].Actor != db.ActorSystem {
+		t.Fatalf("FetchUserHistory returned %+v, want addition by system", events)
+	}
+
+	err = database.EnrollRollout(ctx, segment, operatedAt, db.ActorSystem)
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testRemoveSegmentAssignments(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	active := createUser(t, database)
+	expired := createUser(t, database)
+	other := createSegment(t, database, "OTHER", 0)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	expiredAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	addUserSegment(t, database, active.ID, segment.ID, time.Time{})
+	addUserSegment(t, database, active.ID, other.ID, time.Time{})
+	addUserSegment(t, database, expired.ID, segment.ID, expiredAt)
+
+	removedAt := time.Now().Truncate(time.Millisecond)
+	err := database.RemoveSegmentAssignments(ctx, segment.ID, removedAt, "admin")
+	if err != nil {
+		t.Fatalf("RemoveSegmentAssignments: %v", err)
+	}
+	assertSlugs(t, fetchSlugs(t, database, active.ID), "OTHER")
+	members, err := database.FetchSegmentMembers(ctx, segment.ID, uuid.Nil, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(members) != 0 {
+		t.Fatalf("FetchSegmentMembers returned %+v, want none", members)
+	}
+	next, err := database.NextExpiration(ctx)
+	if err != nil {
+		t.Fatalf("NextExpiration: %v", err)
+	}
+	if !next.IsZero() {
+		t.Fatalf("NextExpiration returned %v, want zero time", next)
+	}
+
+	entries, err := database.GetHistory(ctx, monthFilter(removedAt.UTC().Year(), int(removedAt.UTC().Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	got := map[uuid.UUID]db.GetHistory{}
+	for _, entry := range entries {
+		got[entry.UserID] = entry
+	}
+	want := map[uuid.UUID]db.GetHistory{
+		active.ID:  {Operation: db.OperationDelete, OperationAt: removedAt},
+		expired.ID: {Operation: db.OperationExpire, OperationAt: expiredAt},
+	}
+	// expiration an hour ago may fall into previous month
+	if expiredAt.UTC().Month() != removedAt.UTC().Month() {
+		delete(want, expired.ID)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("GetHistory returned %+v, want %+v", entries, want)
+	}
+	for userId, entry := range want {
+		if got[userId].Slug != "SEGMENT" || got[userId].Operation != entry.Operation || !got[userId].OperationAt.Equal(entry.OperationAt) {
+			t.Fatalf("history of user %s is %+v, want %+v", userId, got[userId], entry)
+		}
+	}
+
+	// removal is made by the actor, expiration by system
+	for userId, actor := range map[uuid.UUID]string{active.ID: "admin", expired.ID: db.ActorSystem} {
+		events, err := database.FetchUserHistory(ctx, userId, db.UserHistoryFilter{})
+		if err != nil {
+			t.Fatalf("FetchUserHistory: %v", err)
+		}
+		if len(events) != 1 || events[0].Actor != actor {
+			t.Fatalf("FetchUserHistory of user %s returned %+v, want single event by %s", userId, events, actor)
+		}
+	}
+}
+
+func testDeleteSegment(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	addUserSegment(t, database, user.ID, segment.ID, time.Time{})
+	operatedAt := time.Now()
+	err := database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: operatedAt})
+	if err != nil {
+		t.Fatalf("SaveHistory: %v", err)
+	}
+
+	err = database.DeleteSegment(ctx, "SEGMENT")
+	if err != nil {
+		t.Fatalf("DeleteSegment: %v", err)
+	}
+	_, err = database.FetchSegment(ctx, "SEGMENT")
+	assertErrorKind(t, err, db.ErrNotFound)
+	assertSlugs(t, fetchSlugs(t, database, user.ID))
+	entries, err := database.GetHistory(ctx, monthFilter(operatedAt.UTC().Year(), int(operatedAt.UTC().Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("GetHistory returned %+v, want no entries of deleted segment", entries)
+	}
+
+	err = database.DeleteSegment(ctx, "SEGMENT")
+	assertErrorKind(t, err, db.ErrNotFound)
+
+	// segment with the same slug doesn't get assignments of deleted one
+	created := createSegment(t, database, "SEGMENT", 0)
+	members, err := database.FetchSegmentMembers(ctx, created.ID, uuid.Nil, 0)
+	if err != nil {
+		t.Fatalf("FetchSegmentMembers: %v", err)
+	}
+	if len(members) != 0 {
+		t.Fatalf("FetchSegmentMembers returned %+v, want none", members)
+	}
+}
+
+func testUserSegments(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segmentA := createSegment(t, database, "SEGMENT_A", 0)
+	segmentB := createSegment(t, database, "SEGMENT_B", 0)
+	addUserSegment(t, database, user.ID, segmentA.ID, time.Now().Add(time.Hour))
+	addUserSegment(t, database, user.ID, segmentB.ID, time.Time{})
+	assertSlugs(t, fetchSlugs(t, database, user.ID), "SEGMENT_A", "SEGMENT_B")
+
+	err := database.DeleteUserSegments(ctx, user.ID, segmentA.ID)
+	if err != nil {
+		t.Fatalf("DeleteUserSegments: %v", err)
+	}
+	assertSlugs(t, fetchSlugs(t, database, user.ID), "SEGMENT_B")
+
+	// deleting missing assignment is not an error
+	err = database.DeleteUserSegments(ctx, user.ID, segmentA.ID)
+	if err != nil {
+		t.Fatalf("DeleteUserSegments: %v", err)
+	}
+}
+
+func testDuplicateUserSegment(t *testing.T, database db.Database) {
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	addUserSegment(t, database, user.ID, segment.ID, time.Time{})
+
+	err := database.AddUserSegments(context.Background(), user.ID, segment.ID, time.Now().Add(time.Hour))
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+}
+
+func testDropExpiredSegments(t *testing.T, database db.Database) {
+	now := time.Now().Truncate(time.Microsecond)
+	user := createUser(t, database)
+	expired := createSegment(t, database, "EXPIRED", 0)
+	active := createSegment(t, database, "ACTIVE", 0)
+	permanent := createSegment(t, database, "PERMANENT", 0)
+	addUserSegment(t, database, user.ID, expired.ID, now.Add(-time.Minute))
+	addUserSegment(t, database, user.ID, active.ID, now.Add(time.Hour))
+	addUserSegment(t, database, user.ID, permanent.ID, time.Time{})
+
+	dropped, err := database.DropExpiredSegments(context.Background(), now, 10)
+	if err != nil {
+		t.Fatalf("DropExpiredSegments: %v", err)
+	}
+	if dropped != 1 {
+		t.Fatalf("DropExpiredSegments dropped %d assignments, want 1", dropped)
+	}
+	assertSlugs(t, fetchSlugs(t, database, user.ID), "ACTIVE", "PERMANENT")
+
+	// every expired assignment is recorded in history at its expiration time
+	expiredAt := now.Add(-time.Minute)
+	entries, err := database.GetHistory(context.Background(), monthFilter(expiredAt.Year(), int(expiredAt.Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("GetHistory returned %+v, want single expiration", entries)
+	}
+	entry := entries[0]
+	if entry.UserID != user.ID || entry.Slug != "EXPIRED" || entry.Operation != db.OperationExpire || !entry.OperationAt.Equal(expiredAt.Truncate(time.Microsecond)) {
+		t.Fatalf("GetHistory returned %+v, want expiration of EXPIRED at %v", entry, expiredAt)
+	}
+}
+
+func testDropExpiredSegmentsBatch(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Microsecond)
+	user := createUser(t, database)
+	for i, slug := range []string{"FIRST", "SECOND", "THIRD"} {
+		segment := createSegment(t, database, slug, 0)
+		addUserSegment(t, database, user.ID, segment.ID, now.Add(-time.Duration(3-i)*time.Minute))
+	}
+
+	// the earliest expirations are dropped first
+	dropped, err := database.DropExpiredSegments(ctx, now, 2)
+	if err != nil {
+		t.Fatalf("DropExpiredSegments: %v", err)
+	}
+	if dropped != 2 {
+		t.Fatalf("DropExpiredSegments dropped %d assignments, want 2", dropped)
+	}
+	next, err := database.NextExpiration(ctx)
+	if err != nil {
+		t.Fatalf("NextExpiration: %v", err)
+	}
+	if !next.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("THIRD assignment expiring at %v is left, got %v", now.Add(-time.Minute), next)
+	}
+
+	dropped, err = database.DropExpiredSegments(ctx, now, 2)
+	if err != nil {
+		t.Fatalf("DropExpiredSegments: %v", err)
+	}
+	if dropped != 1 {
+		t.Fatalf("DropExpiredSegments dropped %d assignments, want 1", dropped)
+	}
+}
+
+func testExpiredSegmentsAreHidden(t *testing.T, database db.Database) {
+	user := createUser(t, database)
+	expired := createSegment(t, database, "EXPIRED", 0)
+	active := createSegment(t, database, "ACTIVE", 0)
+	addUserSegment(t, database, user.ID, expired.ID, time.Now().Add(-time.Second))
+	addUserSegment(t, database, user.ID, active.ID, time.Now().Add(time.Hour))
+
+	// expired assignment is not returned even before it is dropped
+	assertSlugs(t, fetchSlugs(t, database, user.ID), "ACTIVE")
+	users, err := database.FetchUsers(context.Background(), db.UsersFilter{})
+	if err != nil {
+		t.Fatalf("FetchUsers: %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("FetchUsers returned %d users, want 1", len(users))
+	}
+	assertSlugs(t, users[0].SegmentSlugs, "ACTIVE")
+}
+
+func testDropExpiredUserSegments(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	now := time.Now()
+	user := createUser(t, database)
+	other := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	addUserSegment(t, database, user.ID, segment.ID, now.Add(-time.Minute))
+	addUserSegment(t, database, other.ID, segment.ID, now.Add(-time.Minute))
+
+	err := database.DropExpiredUserSegments(ctx, user.ID, now)
+	if err != nil {
+		t.Fatalf("DropExpiredUserSegments: %v", err)
+	}
+	// dropped assignment can be added again, other users are not affected
+	addUserSegment(t, database, user.ID, segment.ID, now.Add(time.Hour))
+	err = database.AddUserSegments(ctx, other.ID, segment.ID, now.Add(time.Hour))
+	assertErrorKind(t, err, db.ErrAlreadyExists)
+
+	entries, err := database.GetHistory(ctx, monthFilter(now.Add(-time.Minute).Year(), int(now.Add(-time.Minute).Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].UserID != user.ID || entries[0].Operation != db.OperationExpire {
+		t.Fatalf("GetHistory returned %+v, want single expiration of user %v", entries, user.ID)
+	}
+}
+
+func testNextExpiration(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	next, err := database.NextExpiration(ctx)
+	if err != nil {
+		t.Fatalf("NextExpiration: %v", err)
+	}
+	if !next.IsZero() {
+		t.Fatalf("NextExpiration returned %v for empty database, want zero time", next)
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	user := createUser(t, database)
+	soon := createSegment(t, database, "SOON", 0)
+	later := createSegment(t, database, "LATER", 0)
+	permanent := createSegment(t, database, "PERMANENT", 0)
+	addUserSegment(t, database, user.ID, later.ID, now.Add(time.Hour))
+	addUserSegment(t, database, user.ID, soon.ID, now.Add(time.Minute))
+	addUserSegment(t, database, user.ID, permanent.ID, time.Time{})
+
+	next, err = database.NextExpiration(ctx)
+	if err != nil {
+		t.Fatalf("NextExpiration: %v", err)
+	}
+	if !next.Equal(now.Add(time.Minute)) {
+		t.Fatalf("NextExpiration returned %v, want %v", next, now.Add(time.Minute))
+	}
+}
+
+func testGetHistory(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	deleted := createSegment(t, database, "DELETED", 0)
+
+	added := time.Date(2023, time.August, 10, 12, 0, 0, 0, time.UTC)
+	removed := time.Date(2023, time.August, 20, 12, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(2023, time.September, 1, 12, 0, 0, 0, time.UTC)
+	saves := []struct {
+		segmentId   uuid.UUID
+		operation   string
+		operationAt time.Time
+	}{
+		{segment.ID, db.OperationDelete, removed},
+		{segment.ID, db.OperationAdd, added},
+		{segment.ID, db.OperationAdd, nextMonth},
+		{deleted.ID, db.OperationAdd, added},
+	}
+	for _, save := range saves {
+		err := database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: save.segmentId, Operation: save.operation, OperationAt: save.operationAt})
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+	err := database.DeleteSegment(ctx, "DELETED")
+	if err != nil {
+		t.Fatalf("DeleteSegment: %v", err)
+	}
+
+	entries, err := database.GetHistory(ctx, monthFilter(2023, 8))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("GetHistory returned %d entries, want 2: %+v", len(entries), entries)
+	}
+	want := []struct {
+		operation   string
+		operationAt time.Time
+	}{
+		{db.OperationAdd, added},
+		{db.OperationDelete, removed},
+	}
+	for i, entry := range entries {
+		if entry.UserID != user.ID || entry.Slug != "SEGMENT" || entry.Operation != want[i].operation || !entry.OperationAt.Equal(want[i].operationAt) {
+			t.Fatalf("GetHistory entry %d is %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func testGetHistoryFilter(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	other := createUser(t, database)
+	a := createSegment(t, database, "A", 0)
+	b := createSegment(t, database, "B", 0)
+
+	start := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+	entries := []db.UserSegmentHistory{
+		{UserID: user.ID, SegmentID: a.ID, Operation: db.OperationAdd, OperationAt: start.Add(-time.Microsecond)},
+		{UserID: user.ID, SegmentID: a.ID, Operation: db.OperationDelete, OperationAt: start},
+		{UserID: user.ID, SegmentID: b.ID, Operation: db.OperationAdd, OperationAt: start.Add(time.Hour)},
+		{UserID: other.ID, SegmentID: a.ID, Operation: db.OperationAdd, OperationAt: start.Add(time.Hour)},
+		{UserID: user.ID, SegmentID: b.ID, Operation: db.OperationExpire, OperationAt: start.Add(2 * time.Hour)},
+	}
+	for _, entry := range entries {
+		err := database.SaveHistory(ctx, entry)
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter db.HistoryFilter
+		want   []string
+	}{
+		{"all", db.HistoryFilter{}, []string{"A " + db.OperationAdd, "A " + db.OperationDelete, "B " + db.OperationAdd, "A " + db.OperationAdd, "B " + db.OperationExpire}},
+		{"range", db.HistoryFilter{From: start, To: start.Add(2 * time.Hour)}, []string{"A " + db.OperationDelete, "B " + db.OperationAdd, "A " + db.OperationAdd}},
+		{"segments", db.HistoryFilter{From: start, SegmentSlugs: []string{"B"}}, []string{"B " + db.OperationAdd, "B " + db.OperationExpire}},
+		{"users", db.HistoryFilter{UserIDs: []uuid.UUID{other.ID}}, []string{"A " + db.OperationAdd}},
+		{"operation", db.HistoryFilter{UserIDs: []uuid.UUID{user.ID, other.ID}, Operation: db.OperationAdd}, []string{"A " + db.OperationAdd, "B " + db.OperationAdd, "A " + db.OperationAdd}},
+	} {
+		fetched, err := database.GetHistory(ctx, test.filter)
+		if err != nil {
+			t.Fatalf("GetHistory %s: %v", test.name, err)
+		}
+		got := make([]string, 0, len(fetched))
+		for _, entry := range fetched {
+			got = append(got, entry.Slug+" "+entry.Operation)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("GetHistory %s returned %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func testStreamHistory(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	other := createSegment(t, database, "OTHER", 0)
+
+	start := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		err := database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: start.Add(time.Duration(i) * time.Hour)})
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+	err := database.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: other.ID, Operation: db.OperationAdd, OperationAt: start})
+	if err != nil {
+		t.Fatalf("SaveHistory: %v", err)
+	}
+
+	filter := db.HistoryFilter{SegmentSlugs: []string{"SEGMENT"}}
+	for _, test := range []struct {
+		batchSize int
+		want      []int
+	}{
+		{2, []int{2, 2, 1}},
+		{5, []int{5}},
+		{10, []int{5}},
+	} {
+		var sizes []int
+		var streamed []db.GetHistory
+		err = database.StreamHistory(ctx, filter, test.batchSize, func(entries []db.GetHistory) error {
+			sizes = append(sizes, len(entries))
+			streamed = append(streamed, entries...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("StreamHistory: %v", err)
+		}
+		if !reflect.DeepEqual(sizes, test.want) {
+			t.Fatalf("StreamHistory by %d returned batches of %v, want %v", test.batchSize, sizes, test.want)
+		}
+		for i, entry := range streamed {
+			if entry.Slug != "SEGMENT" || !entry.OperationAt.Equal(start.Add(time.Duration(i)*time.Hour)) {
+				t.Fatalf("StreamHistory entry %d is %+v, want entry of SEGMENT at %v", i, entry, start.Add(time.Duration(i)*time.Hour))
+			}
+		}
+	}
+
+	stop := errors.New("stop")
+	err = database.StreamHistory(ctx, filter, 2, func(entries []db.GetHistory) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("StreamHistory returned %v, want error of fn", err)
+	}
+}
+
+func testFetchUserSegmentsAt(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	other := createUser(t, database)
+	segments := map[string]uuid.UUID{}
+	for _, slug := range []string{"A", "B", "C", "D", "OTHER"} {
+		segments[slug] = createSegment(t, database, slug, 0).ID
+	}
+
+	added := time.Date(2023, time.August, 1, 12, 0, 0, 0, time.UTC)
+	expired := added.Add(time.Hour)
+	removed := added.Add(2 * time.Hour)
+	readded := added.Add(3 * time.Hour)
+	entries := []db.UserSegmentHistory{
+		{UserID: user.ID, SegmentID: segments["A"], Operation: db.OperationAdd, OperationAt: added},
+		{UserID: user.ID, SegmentID: segments["A"], Operation: db.OperationDelete, OperationAt: removed},
+		// expiration of B is not recorded yet
+		{UserID: user.ID, SegmentID: segments["B"], Operation: db.OperationAdd, OperationAt: added, ExpiresAt: expired},
+		{UserID: user.ID, SegmentID: segments["C"], Operation: db.OperationAdd, OperationAt: added, ExpiresAt: expired},
+		{UserID: user.ID, SegmentID: segments["C"], Operation: db.OperationExpire, OperationAt: expired},
+		{UserID: user.ID, SegmentID: segments["C"], Operation: db.OperationAdd, OperationAt: readded},
+		// entries of the same time are applied in saving order
+		{UserID: user.ID, SegmentID: segments["D"], Operation: db.OperationDelete, OperationAt: added},
+		{UserID: user.ID, SegmentID: segments["D"], Operation: db.OperationAdd, OperationAt: added},
+		{UserID: other.ID, SegmentID: segments["OTHER"], Operation: db.OperationAdd, OperationAt: added},
+	}
+	for _, entry := range entries {
+		err := database.SaveHistory(ctx, entry)
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		at   time.Time
+		want []string
+	}{
+		{added.Add(-time.Second), nil},
+		{added, []string{"A", "B", "C", "D"}},
+		{expired.Add(-time.Second), []string{"A", "B", "C", "D"}},
+		{expired, []string{"A", "D"}},
+		{removed, []string{"D"}},
+		{readded, []string{"C", "D"}},
+	} {
+		fetched, err := database.FetchUserSegmentsAt(ctx, user.ID, test.at)
+		if err != nil {
+			t.Fatalf("FetchUserSegmentsAt: %v", err)
+		}
+		slugs := make([]string, 0, len(fetched))
+		for _, segment := range fetched {
+			slugs = append(slugs, segment.Slug)
+		}
+		if strings.Join(slugs, ",") != strings.Join(test.want, ",") {
+			t.Fatalf("FetchUserSegmentsAt %v returned %v, want %v", test.at, slugs, test.want)
+		}
+	}
+
+	fetched, err := database.FetchUserSegmentsAt(ctx, user.ID, added)
+	if err != nil {
+		t.Fatalf("FetchUserSegmentsAt: %v", err)
+	}
+	b := fetched[1]
+	if !b.AddedAt.Equal(added) || b.ExpiresAt == nil || !b.ExpiresAt.Equal(expired) || fetched[0].ExpiresAt != nil {
+		t.Fatalf("FetchUserSegmentsAt returned %+v, want B added at %v expiring at %v and A without expiration", fetched, added, expired)
+	}
+}
+
+func testFetchUserHistory(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	other := createUser(t, database)
+	a := createSegment(t, database, "A", 0)
+	b := createSegment(t, database, "B", 0)
+
+	added := time.Date(2023, time.August, 1, 12, 0, 0, 0, time.UTC)
+	expires := added.Add(24 * time.Hour)
+	removed := added.Add(time.Hour)
+	entries := []db.UserSegmentHistory{
+		{UserID: user.ID, SegmentID: a.ID, Operation: db.OperationAdd, OperationAt: added, ExpiresAt: expires, Actor: "admin"},
+		{UserID: user.ID, SegmentID: b.ID, Operation: db.OperationAdd, OperationAt: added, Actor: db.ActorSystem},
+		{UserID: other.ID, SegmentID: a.ID, Operation: db.OperationAdd, OperationAt: added},
+		{UserID: user.ID, SegmentID: b.ID, Operation: db.OperationDelete, OperationAt: removed},
+		// later saved entry of earlier time goes first
+		{UserID: user.ID, SegmentID: a.ID, Operation: db.OperationDelete, OperationAt: added.Add(-time.Hour)},
+	}
+	for _, entry := range entries {
+		err := database.SaveHistory(ctx, entry)
+		if err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+
+	events, err := database.FetchUserHistory(ctx, user.ID, db.UserHistoryFilter{})
+	if err != nil {
+		t.Fatalf("FetchUserHistory: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("FetchUserHistory returned %+v, want 4 events", events)
+	}
+	first, addA, addB, removeB := events[0], events[1], events[2], events[3]
+	if first.Slug != "A" || first.Operation != db.OperationDelete || first.ExpiresAt != nil || first.Actor != "" {
+		t.Fatalf("first event is %+v, want removal of A by unknown actor", first)
+	}
+	if addA.Slug != "A" || !addA.OperationAt.Equal(added) || addA.ExpiresAt == nil || !addA.ExpiresAt.Equal(expires) || addA.Actor != "admin" {
+		t.Fatalf("second event is %+v, want addition of A by admin expiring at %v", addA, expires)
+	}
+	if addB.Slug != "B" || addB.ExpiresAt != nil || addB.Actor != db.ActorSystem || addA.ID >= addB.ID {
+		t.Fatalf("third event is %+v, want addition of B by system after %+v", addB, addA)
+	}
+	if removeB.Slug != "B" || removeB.Operation != db.OperationDelete || !removeB.OperationAt.Equal(removed) {
+		t.Fatalf("fourth event is %+v, want removal of B at %v", removeB, removed)
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter db.UserHistoryFilter
+		want   []int64
+	}{
+		{"limit", db.UserHistoryFilter{Limit: 2}, []int64{first.ID, addA.ID}},
+		{"after", db.UserHistoryFilter{AfterID: addA.ID, AfterOperationAt: addA.OperationAt}, []int64{addB.ID, removeB.ID}},
+		{"range", db.UserHistoryFilter{From: added, To: removed}, []int64{addA.ID, addB.ID}},
+		{"segments", db.UserHistoryFilter{SegmentSlugs: []string{"B"}}, []int64{addB.ID, removeB.ID}},
+	} {
+		fetched, err := database.FetchUserHistory(ctx, user.ID, test.filter)
+		if err != nil {
+			t.Fatalf("FetchUserHistory %s: %v", test.name, err)
+		}
+		ids := make([]int64, 0, len(fetched))
+		for _, event := range fetched {
+			ids = append(ids, event.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Fatalf("FetchUserHistory %s returned %v, want %v", test.name, ids, test.want)
+		}
+	}
+}
+
+func testTransactionCommit(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := db.Users{ID: uuid.New(), Name: "user"}
+
+	err := database.RunInTransaction(ctx, func(tx db.Database) error {
+		_, err := tx.CreateUser(ctx, user)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("RunInTransaction: %v", err)
+	}
+	if !userExists(t, database, user.ID) {
+		t.Fatal("user created in committed transaction doesn't exist")
+	}
+}
+
+func testTransactionRollback(t *testing.T, database db.Database) {
+	ctx := context.Background()
+	user := createUser(t, database)
+	segment := createSegment(t, database, "SEGMENT", 0)
+	errAbort := errors.New("abort")
+
+	err := database.RunInTransaction(ctx, func(tx db.Database) error {
+		err := tx.AddUserSegments(ctx, user.ID, segment.ID, time.Time{})
+		if err != nil {
+			return err
+		}
+		err = tx.SaveHistory(ctx, db.UserSegmentHistory{UserID: user.ID, SegmentID: segment.ID, Operation: db.OperationAdd, OperationAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		// nested transaction joins the outer one
+		err = tx.RunInTransaction(ctx, func(nested db.Database) error {
+			_, err := nested.CreateUser(ctx, db.Users{ID: uuid.New(), Name: "nested"})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		assertSlugs(t, fetchSlugs(t, tx, user.ID), "SEGMENT")
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("RunInTransaction returned %v, want %v", err, errAbort)
+	}
+
+	assertSlugs(t, fetchSlugs(t, database, user.ID))
+	userIds, err := database.FetchUserIDs(ctx)
+	if err != nil {
+		t.Fatalf("FetchUserIDs: %v", err)
+	}
+	if len(userIds) != 1 {
+		t.Fatalf("rolled back transaction left %d users, want 1", len(userIds))
+	}
+	now := time.Now()
+	entries, err := database.GetHistory(ctx, monthFilter(now.Year(), int(now.Month())))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("rolled back transaction left history %+v", entries)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+)
+
+// error kinds, check them with errors.Is
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrConflict      = errors.New("conflict")
+	ErrValidation    = errors.New("validation error")
+)
+
+// Error is domain error of one of the kinds above with human readable message
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+	// Details describe invalid request fields
+	Details []FieldError
+}
+
+// FieldError points to invalid value of request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+func NewError(kind error, format string, args ...interface{}) *Error {
+	return &Error{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+// translate converts go-pg and postgres errors into domain errors, subject names the entity in the message
+func translate(err error, subject string) error {
+	if err == nil {
+		return nil
+	}
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		return err
+	}
+	if errors.Is(err, pg.ErrNoRows) {
+		return &Error{Kind: ErrNotFound, Message: subject + " not found", Err: err}
+	}
+
+	var pgErr pg.Error
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch pgErr.Field('C') {
+	// unique_violation
+	case "23505":
+		return &Error{Kind: ErrAlreadyExists, Message: subject + " already exists", Err: err}
+	// foreign_key_violation, serialization_failure, deadlock_detected
+	case "23503", "40001", "40P01":
+		return &Error{Kind: ErrConflict, Message: subject + " conflicts with concurrent or related changes", Err: err}
+	// not_null_violation, check_violation, invalid_text_representation, string_data_right_truncation, datetime_field_overflow
+	case "23502", "23514", "22P02", "22001", "22008":
+		return &Error{Kind: ErrValidation, Message: "invalid " + subject, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"github.com/go-pg/pg/v10"
+	"sync"
+)
+
+// runnerLockKey is postgres advisory lock key held by the instance which runs background jobs
+const runnerLockKey = 4723102
+
+// AdvisoryLeader elects leader with session level postgres advisory lock.
+// Lock is held by dedicated connection, so it is released by postgres if the instance dies.
+// Instances are distinguished by application_name connection option.
+type AdvisoryLeader struct {
+	db   *pg.DB
+	mu   sync.Mutex
+	conn *pg.Conn
+}
+
+func NewAdvisoryLeader(db *pg.DB) *AdvisoryLeader {
+	return &AdvisoryLeader{
+		db: db,
+	}
+}
+
+// TryAcquire takes leadership if nobody holds it and reports whether this instance is the leader
+func (l *AdvisoryLeader) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		// advisory locks are reentrant, so held lock is only checked to be alive
+		_, err := l.conn.ExecContext(ctx, "SELECT 1")
+		if err == nil {
+			return true, nil
+		}
+		_ = l.conn.Close()
+		l.conn = nil
+		return false, err
+	}
+
+	conn := l.db.Conn()
+	var acquired bool
+	_, err := conn.QueryOneContext(ctx, pg.Scan(&acquired), "SELECT pg_try_advisory_lock(?)", runnerLockKey)
+	if err != nil || !acquired {
+		_ = conn.Close()
+		return false, err
+	}
+	l.conn = conn
+	return true, nil
+}
+
+// Release gives up leadership if this instance holds it
+func (l *AdvisoryLeader) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock(?)", runnerLockKey)
+	closeErr := l.conn.Close()
+	l.conn = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Leader returns application name of the instance holding leadership, empty string if there is no leader
+func (l *AdvisoryLeader) Leader(ctx context.Context) (string, error) {
+	var leaders []string
+	query := `
+    SELECT
+        a.application_name
+    FROM
+        pg_locks l
+    JOIN
+        pg_stat_activity a ON a.pid = l.pid
+    WHERE
+        l.locktype = 'advisory'
+    AND
+        l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+    AND
+        l.classid = 0 AND l.objid = ? AND l.objsubid = 1
+    AND
+        l.granted
+`
+	_, err := l.db.QueryContext(ctx, &leaders, query, runnerLockKey)
+	if err != nil {
+		return "", err
+	}
+	if len(leaders) == 0 {
+		return "", nil
+	}
+	return leaders[0], nil
+}
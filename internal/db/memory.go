@@ -0,0 +1,894 @@
+package db
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is in-memory Database implementation, it behaves like Sql and is used in tests
+type Memory struct {
+	mu    *sync.Mutex
+	state *memoryState
+	inTx  bool
+}
+
+type memoryState struct {
+	users       map[uuid.UUID]Users
+	segments    map[uuid.UUID]Segments
+	assignments map[assignmentKey]SegmentAssignments
+	aliases     map[string]SegmentAliases
+	history     []UserSegmentHistory
+	// lastHistoryID imitates bigserial id of history entries
+	lastHistoryID int64
+}
+
+type assignmentKey struct {
+	userId    uuid.UUID
+	segmentId uuid.UUID
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		mu: &sync.Mutex{},
+		state: &memoryState{
+			users:       map[uuid.UUID]Users{},
+			segments:    map[uuid.UUID]Segments{},
+			assignments: map[assignmentKey]SegmentAssignments{},
+			aliases:     map[string]SegmentAliases{},
+		},
+	}
+}
+
+func (s *memoryState) clone() *memoryState {
+	cloned := &memoryState{
+		users:       make(map[uuid.UUID]Users, len(s.users)),
+		segments:    make(map[uuid.UUID]Segments, len(s.segments)),
+		assignments: make(map[assignmentKey]SegmentAssignments, len(s.assignments)),
+		aliases:     make(map[string]SegmentAliases, len(s.aliases)),
+		history:     make([]UserSegmentHistory, len(s.history)),
+		// ids of new entries continue after entries of the state
+		lastHistoryID: s.lastHistoryID,
+	}
+	for id, user := range s.users {
+		cloned.users[id] = user
+	}
+	for id, segment := range s.segments {
+		cloned.segments[id] = segment
+	}
+	for key, assignment := range s.assignments {
+		cloned.assignments[key] = assignment
+	}
+	for slug, alias := range s.aliases {
+		cloned.aliases[slug] = alias
+	}
+	copy(cloned.history, s.history)
+	return cloned
+}
+
+// expired assignments are treated as removed even before they are dropped
+func (a SegmentAssignments) expired(timeNow time.Time) bool {
+	// zero expiration time is stored as NULL and never expires
+	return !a.DeleteAt.IsZero() && !a.DeleteAt.After(timeNow)
+}
+
+// dropExpired drops up to limit earliest expired assignments, limit <= 0 means no limit
+func (s *memoryState) dropExpired(timeNow time.Time, limit int, filter func(key assignmentKey) bool) int {
+	expired := []SegmentAssignments{}
+	for key, assignment := range s.assignments {
+		if filter(key) && assignment.expired(timeNow) {
+			expired = append(expired, assignment)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].DeleteAt.Before(expired[j].DeleteAt)
+	})
+	if limit > 0 && len(expired) > limit {
+		expired = expired[:limit]
+	}
+	for _, assignment := range expired {
+		delete(s.assignments, assignmentKey{userId: assignment.UserID, segmentId: assignment.SegmentID})
+		s.saveHistory(UserSegmentHistory{
+			UserID:      assignment.UserID,
+			SegmentID:   assignment.SegmentID,
+			Operation:   OperationExpire,
+			OperationAt: assignment.DeleteAt,
+			Actor:       ActorSystem,
+		})
+	}
+	return len(expired)
+}
+
+// exists checks rows referenced by foreign keys of assignments and history, deleted users still exist
+func (s *memoryState) exists(userId, segmentId uuid.UUID) bool {
+	_, userOk := s.users[userId]
+	_, segmentOk := s.segments[segmentId]
+	return userOk && segmentOk
+}
+
+func (s *memoryState) saveHistory(entry UserSegmentHistory) {
+	s.lastHistoryID++
+	entry.ID = s.lastHistoryID
+	s.history = append(s.history, entry)
+}
+
+func (s *memoryState) segmentBySlug(slug string) (Segments, bool) {
+	for _, segment := range s.segments {
+		if segment.Slug == slug {
+			return segment, true
+		}
+	}
+	return Segments{}, false
+}
+
+// resolveSegment finds segment by current slug or by not expired alias
+func (s *memoryState) resolveSegment(slug string) (Segments, bool) {
+	segment, ok := s.segmentBySlug(slug)
+	if ok {
+		return segment, true
+	}
+	alias, ok := s.aliases[slug]
+	if !ok || !alias.ExpiresAt.After(time.Now()) {
+		return Segments{}, false
+	}
+	segment, ok = s.segments[alias.SegmentID]
+	return segment, ok
+}
+
+// activeUser finds not deleted user
+func (s *memoryState) activeUser(userId uuid.UUID) (Users, bool) {
+	user, ok := s.users[userId]
+	if !ok || user.DeletedAt != nil {
+		return Users{}, false
+	}
+	return user, true
+}
+
+// userByExternalID finds not deleted user with external id, deleted users keep their external ids but don't hold them
+func (s *memoryState) userByExternalID(externalId string) (Users, bool) {
+	if externalId == "" {
+		return Users{}, false
+	}
+	for _, user := range s.users {
+		if user.ExternalID == externalId && user.DeletedAt == nil {
+			return user, true
+		}
+	}
+	return Users{}, false
+}
+
+func (s *memoryState) userWithSegments(userId uuid.UUID) UserWithSegments {
+	timeNow := time.Now()
+	slugs := []string{}
+	for key, assignment := range s.assignments {
+		if key.userId != userId || assignment.expired(timeNow) {
+			continue
+		}
+		// assignments of deleted segments are skipped like in Sql join
+		segment, ok := s.segments[key.segmentId]
+		if !ok {
+			continue
+		}
+		slugs = append(slugs, segment.Slug)
+	}
+	sort.Strings(slugs)
+	return UserWithSegments{
+		UserID:       userId,
+		Name:         s.users[userId].Name,
+		ExternalID:   s.users[userId].ExternalID,
+		SegmentSlugs: slugs,
+	}
+}
+
+// lock is no-op inside transaction because transaction already holds the lock
+func (m *Memory) lock() {
+	if !m.inTx {
+		m.mu.Lock()
+	}
+}
+
+func (m *Memory) unlock() {
+	if !m.inTx {
+		m.mu.Unlock()
+	}
+}
+
+// RunInTransaction runs fn against copy of the state and applies it only if fn succeeds
+func (m *Memory) RunInTransaction(ctx context.Context, fn func(tx Database) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &Memory{
+		mu:    m.mu,
+		state: m.state.clone(),
+		inTx:  true,
+	}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	*m.state = *tx.state
+	return nil
+}
+
+func (m *Memory) FetchUsers(ctx context.Context, filter UsersFilter) ([]UserWithSegments, error) {
+	m.lock()
+	defer m.unlock()
+
+	users := make([]UserWithSegments, 0, len(m.state.users))
+	for userId, user := range m.state.users {
+		if user.DeletedAt != nil || !strings.HasPrefix(user.Name, filter.NamePrefix) {
+			continue
+		}
+		withSegments := m.state.userWithSegments(userId)
+		if filter.NoSegments && len(withSegments.SegmentSlugs) > 0 {
+			continue
+		}
+		if filter.SegmentSlug != "" && !containsString(withSegments.SegmentSlugs, filter.SegmentSlug) {
+			continue
+		}
+		users = append(users, withSegments)
+	}
+
+	// uuid strings are compared like uuid values in postgres
+	less := func(a, b UserWithSegments) bool {
+		return a.UserID.String() < b.UserID.String()
+	}
+	if filter.Sort == UsersSortName {
+		less = func(a, b UserWithSegments) bool {
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return a.UserID.String() < b.UserID.String()
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return less(users[i], users[j])
+	})
+	if filter.AfterID != uuid.Nil {
+		after := UserWithSegments{UserID: filter.AfterID, Name: filter.AfterName}
+		start := sort.Search(len(users), func(i int) bool {
+			return less(after, users[i])
+		})
+		users = users[start:]
+	}
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegments, error) {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.activeUser(userId)
+	if !ok {
+		return UserWithSegments{}, NewError(ErrNotFound, "user %s not found", userId)
+	}
+	return m.state.userWithSegments(userId), nil
+}
+
+func (m *Memory) FetchUserByExternalID(ctx context.Context, externalId string) (Users, error) {
+	m.lock()
+	defer m.unlock()
+
+	user, ok := m.state.userByExternalID(externalId)
+	if !ok {
+		return Users{}, NewError(ErrNotFound, "user with external id %s not found", externalId)
+	}
+	return user, nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user Users) (Users, error) {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.users[user.ID]
+	if ok {
+		return Users{}, NewError(ErrAlreadyExists, "user %s already exists", user.ID)
+	}
+	if user.ExternalID != "" {
+		_, ok = m.state.userByExternalID(user.ExternalID)
+		if ok {
+			return Users{}, NewError(ErrAlreadyExists, "user with external id %s already exists", user.ExternalID)
+		}
+	}
+	m.state.users[user.ID] = user
+	return user, nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, userId uuid.UUID, deletedAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	user, ok := m.state.activeUser(userId)
+	if !ok {
+		return NewError(ErrNotFound, "user %s not found", userId)
+	}
+	user.DeletedAt = &deletedAt
+	m.state.users[userId] = user
+	return nil
+}
+
+func (m *Memory) EraseUser(ctx context.Context, userId uuid.UUID) error {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.users[userId]
+	if !ok {
+		return NewError(ErrNotFound, "user %s not found", userId)
+	}
+	delete(m.state.users, userId)
+	// foreign keys of Sql: assignments are deleted, history is anonymized
+	for key := range m.state.assignments {
+		if key.userId == userId {
+			delete(m.state.assignments, key)
+		}
+	}
+	for i := range m.state.history {
+		if m.state.history[i].UserID == userId {
+			m.state.history[i].UserID = uuid.Nil
+		}
+	}
+	return nil
+}
+
+func (m *Memory) CreateSegment(ctx context.Context, segment Segments) (Segments, error) {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.segments[segment.ID]
+	if ok {
+		return Segments{}, NewError(ErrAlreadyExists, "segment %s already exists", segment.ID)
+	}
+	_, ok = m.state.segmentBySlug(segment.Slug)
+	if ok {
+		return Segments{}, NewError(ErrAlreadyExists, "segment %s already exists", segment.Slug)
+	}
+	if segment.CreatedAt.IsZero() {
+		segment.CreatedAt = time.Now()
+	}
+	if segment.UpdatedAt.IsZero() {
+		segment.UpdatedAt = segment.CreatedAt
+	}
+	if segment.Tags == nil {
+		segment.Tags = []string{}
+	}
+	m.state.segments[segment.ID] = segment
+	return segment, nil
+}
+
+func (m *Memory) FetchSegment(ctx context.Context, slug string) (Segments, error) {
+	m.lock()
+	defer m.unlock()
+
+	segment, ok := m.state.resolveSegment(slug)
+	if !ok {
+		return Segments{}, NewError(ErrNotFound, "segment %s not found", slug)
+	}
+	return segment, nil
+}
+
+func (s *memoryState) segmentDetails(segment Segments) SegmentDetails {
+	timeNow := time.Now()
+	details := SegmentDetails{
+		ID:          segment.ID,
+		Slug:        segment.Slug,
+		Percent:     segment.Percent,
+		Description: segment.Description,
+		Owner:       segment.Owner,
+		Tags:        segment.Tags,
+		CreatedAt:   segment.CreatedAt,
+		UpdatedAt:   segment.UpdatedAt,
+		ArchivedAt:  segment.ArchivedAt,
+	}
+	for key, assignment := range s.assignments {
+		_, ok := s.users[key.userId]
+		if key.segmentId == segment.ID && ok && !assignment.expired(timeNow) {
+			details.MemberCount++
+		}
+	}
+	return details
+}
+
+func (m *Memory) FetchSegmentDetails(ctx context.Context, slug string) (SegmentDetails, error) {
+	m.lock()
+	defer m.unlock()
+
+	segment, ok := m.state.resolveSegment(slug)
+	if !ok {
+		return SegmentDetails{}, NewError(ErrNotFound, "segment %s not found", slug)
+	}
+	return m.state.segmentDetails(segment), nil
+}
+
+func (m *Memory) FetchSegments(ctx context.Context, filter SegmentsFilter) ([]SegmentDetails, error) {
+	m.lock()
+	defer m.unlock()
+
+	search := strings.ToLower(filter.Search)
+	segments := []SegmentDetails{}
+	for _, segment := range m.state.segments {
+		if (filter.AfterSlug != "" && segment.Slug <= filter.AfterSlug) || !strings.Contains(strings.ToLower(segment.Slug), search) {
+			continue
+		}
+		if (filter.Owner != "" && segment.Owner != filter.Owner) || (filter.Tag != "" && !containsString(segment.Tags, filter.Tag)) || segment.Archived() != filter.Archived {
+			continue
+		}
+		segments = append(segments, m.state.segmentDetails(segment))
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Slug < segments[j].Slug
+	})
+	if filter.Limit > 0 && len(segments) > filter.Limit {
+		segments = segments[:filter.Limit]
+	}
+	return segments, nil
+}
+
+func (m *Memory) FetchSegmentMembers(ctx context.Context, segmentId, afterUserId uuid.UUID, limit int) ([]SegmentMember, error) {
+	m.lock()
+	defer m.unlock()
+
+	timeNow := time.Now()
+	members := []SegmentMember{}
+	for key, assignment := range m.state.assignments {
+		user, ok := m.state.users[key.userId]
+		if key.segmentId != segmentId || !ok || assignment.expired(timeNow) || key.userId.String() <= afterUserId.String() {
+			continue
+		}
+		member := SegmentMember{
+			UserID:     user.ID,
+			Name:       user.Name,
+			ExternalID: user.ExternalID,
+		}
+		if !assignment.DeleteAt.IsZero() {
+			expiresAt := assignment.DeleteAt
+			member.ExpiresAt = &expiresAt
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID.String() < members[j].UserID.String()
+	})
+	if limit > 0 && len(members) > limit {
+		members = members[:limit]
+	}
+	return members, nil
+}
+
+func (m *Memory) FetchRolloutSegments(ctx context.Context) ([]Segments, error) {
+	m.lock()
+	defer m.unlock()
+
+	segments := []Segments{}
+	for _, segment := range m.state.segments {
+		if segment.Percent > 0 && !segment.Archived() {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Slug < segments[j].Slug
+	})
+	return segments, nil
+}
+
+func (m *Memory) UpdateSegment(ctx context.Context, segment Segments) error {
+	m.lock()
+	defer m.unlock()
+
+	stored, ok := m.state.segments[segment.ID]
+	if !ok {
+		return nil
+	}
+	existed, ok := m.state.segmentBySlug(segment.Slug)
+	if ok && existed.ID != segment.ID {
+		return NewError(ErrAlreadyExists, "segment %s already exists", segment.Slug)
+	}
+	stored.Slug = segment.Slug
+	stored.Description = segment.Description
+	stored.Owner = segment.Owner
+	stored.Tags = append([]string{}, segment.Tags...)
+	stored.UpdatedAt = segment.UpdatedAt
+	stored.ArchivedAt = segment.ArchivedAt
+	m.state.segments[segment.ID] = stored
+	return nil
+}
+
+func (m *Memory) DeleteSegment(ctx context.Context, slug string) error {
+	m.lock()
+	defer m.unlock()
+
+	segment, ok := m.state.segmentBySlug(slug)
+	if !ok {
+		return NewError(ErrNotFound, "segment %s not found", slug)
+	}
+	delete(m.state.segments, segment.ID)
+	for aliasSlug, alias := range m.state.aliases {
+		if alias.SegmentID == segment.ID {
+			delete(m.state.aliases, aliasSlug)
+		}
+	}
+	for key := range m.state.assignments {
+		if key.segmentId == segment.ID {
+			delete(m.state.assignments, key)
+		}
+	}
+	history := m.state.history[:0]
+	for _, entry := range m.state.history {
+		if entry.SegmentID != segment.ID {
+			history = append(history, entry)
+		}
+	}
+	m.state.history = history
+	return nil
+}
+
+// removeAssignments removes assignments matching filter and records their removal in history,
+// expired assignments are recorded like dropExpired does
+func (s *memoryState) removeAssignments(operatedAt time.Time, actor string, filter func(key assignmentKey) bool) {
+	s.dropExpired(operatedAt, 0, filter)
+	removed := []SegmentAssignments{}
+	for key, assignment := range s.assignments {
+		if filter(key) {
+			removed = append(removed, assignment)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		if removed[i].UserID != removed[j].UserID {
+			return removed[i].UserID.String() < removed[j].UserID.String()
+		}
+		return removed[i].SegmentID.String() < removed[j].SegmentID.String()
+	})
+	for _, assignment := range removed {
+		delete(s.assignments, assignmentKey{userId: assignment.UserID, segmentId: assignment.SegmentID})
+		s.saveHistory(UserSegmentHistory{
+			UserID:      assignment.UserID,
+			SegmentID:   assignment.SegmentID,
+			Operation:   OperationDelete,
+			OperationAt: operatedAt,
+			Actor:       actor,
+		})
+	}
+}
+
+func (m *Memory) RemoveSegmentAssignments(ctx context.Context, segmentId uuid.UUID, operatedAt time.Time, actor string) error {
+	m.lock()
+	defer m.unlock()
+
+	m.state.removeAssignments(operatedAt, actor, func(key assignmentKey) bool {
+		return key.segmentId == segmentId
+	})
+	return nil
+}
+
+func (m *Memory) RemoveUserAssignments(ctx context.Context, userId uuid.UUID, operatedAt time.Time, actor string) error {
+	m.lock()
+	defer m.unlock()
+
+	m.state.removeAssignments(operatedAt, actor, func(key assignmentKey) bool {
+		return key.userId == userId
+	})
+	return nil
+}
+
+func (m *Memory) EnrollRollout(ctx context.Context, segment Segments, operatedAt time.Time, actor string) error {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.segments[segment.ID]
+	if !ok {
+		return NewError(ErrConflict, "segment %s of rollout doesn't exist", segment.ID)
+	}
+	// like single Sql statement, enrollment fails before any change if some user already has the segment
+	enrolled := []uuid.UUID{}
+	for userId, user := range m.state.users {
+		if user.DeletedAt != nil || !segment.InRollout(userId) {
+			continue
+		}
+		_, ok = m.state.assignments[assignmentKey{userId: userId, segmentId: segment.ID}]
+		if ok {
+			return NewError(ErrAlreadyExists, "segment %s of user %s already exists", segment.ID, userId)
+		}
+		enrolled = append(enrolled, userId)
+	}
+	sort.Slice(enrolled, func(i, j int) bool {
+		return enrolled[i].String() < enrolled[j].String()
+	})
+	for _, userId := range enrolled {
+		key := assignmentKey{userId: userId, segmentId: segment.ID}
+		m.state.assignments[key] = SegmentAssignments{UserID: userId, SegmentID: segment.ID}
+		m.state.saveHistory(UserSegmentHistory{
+			UserID:      userId,
+			SegmentID:   segment.ID,
+			Operation:   OperationAdd,
+			OperationAt: operatedAt,
+			Actor:       actor,
+		})
+	}
+	return nil
+}
+
+func (m *Memory) SaveSegmentAlias(ctx context.Context, alias SegmentAliases) error {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.segments[alias.SegmentID]
+	if !ok {
+		return NewError(ErrConflict, "segment %s of alias %s doesn't exist", alias.SegmentID, alias.Slug)
+	}
+	m.state.aliases[alias.Slug] = alias
+	return nil
+}
+
+func (m *Memory) DeleteSegmentAlias(ctx context.Context, slug string) error {
+	m.lock()
+	defer m.unlock()
+
+	delete(m.state.aliases, slug)
+	return nil
+}
+
+func (m *Memory) FetchUserIDs(ctx context.Context) ([]uuid.UUID, error) {
+	m.lock()
+	defer m.unlock()
+
+	userIds := make([]uuid.UUID, 0, len(m.state.users))
+	for userId, user := range m.state.users {
+		if user.DeletedAt == nil {
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds, nil
+}
+
+func (m *Memory) CheckExistedUser(ctx context.Context, userId uuid.UUID) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	_, ok := m.state.activeUser(userId)
+	return ok, nil
+}
+
+func (m *Memory) AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID, expirationTime time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	if !m.state.exists(userId, segmentId) {
+		return NewError(ErrConflict, "user %s or segment %s of assignment doesn't exist", userId, segmentId)
+	}
+	key := assignmentKey{userId: userId, segmentId: segmentId}
+	_, ok := m.state.assignments[key]
+	if ok {
+		return NewError(ErrAlreadyExists, "segment %s of user %s already exists", segmentId, userId)
+	}
+	m.state.assignments[key] = SegmentAssignments{
+		UserID:    userId,
+		SegmentID: segmentId,
+		DeleteAt:  expirationTime,
+	}
+	return nil
+}
+
+func (m *Memory) DeleteUserSegments(ctx context.Context, userId, segmentId uuid.UUID) error {
+	m.lock()
+	defer m.unlock()
+
+	delete(m.state.assignments, assignmentKey{userId: userId, segmentId: segmentId})
+	return nil
+}
+
+func (m *Memory) SaveHistory(ctx context.Context, entry UserSegmentHistory) error {
+	m.lock()
+	defer m.unlock()
+
+	if !m.state.exists(entry.UserID, entry.SegmentID) {
+		return NewError(ErrConflict, "user %s or segment %s of history entry doesn't exist", entry.UserID, entry.SegmentID)
+	}
+	m.state.saveHistory(entry)
+	return nil
+}
+
+func (m *Memory) FetchUserSegmentsAt(ctx context.Context, userId uuid.UUID, at time.Time) ([]UserSegment, error) {
+	m.lock()
+	defer m.unlock()
+
+	// history is kept in id order, so later entry of the same time wins
+	last := map[uuid.UUID]UserSegmentHistory{}
+	for _, entry := range m.state.history {
+		if entry.UserID != userId || entry.OperationAt.After(at) {
+			continue
+		}
+		previous, ok := last[entry.SegmentID]
+		if !ok || !entry.OperationAt.Before(previous.OperationAt) {
+			last[entry.SegmentID] = entry
+		}
+	}
+
+	segments := []UserSegment{}
+	for segmentId, entry := range last {
+		segment, ok := m.state.segments[segmentId]
+		if !ok || entry.Operation != OperationAdd || (!entry.ExpiresAt.IsZero() && !entry.ExpiresAt.After(at)) {
+			continue
+		}
+		userSegment := UserSegment{Slug: segment.Slug, AddedAt: entry.OperationAt}
+		if !entry.ExpiresAt.IsZero() {
+			expiresAt := entry.ExpiresAt
+			userSegment.ExpiresAt = &expiresAt
+		}
+		segments = append(segments, userSegment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Slug < segments[j].Slug
+	})
+	return segments, nil
+}
+
+func (m *Memory) FetchUserHistory(ctx context.Context, userId uuid.UUID, filter UserHistoryFilter) ([]HistoryEvent, error) {
+	m.lock()
+	defer m.unlock()
+
+	events := []HistoryEvent{}
+	for _, entry := range m.state.history {
+		if entry.UserID != userId {
+			continue
+		}
+		if !filter.From.IsZero() && entry.OperationAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !entry.OperationAt.Before(filter.To) {
+			continue
+		}
+		segment, ok := m.state.segments[entry.SegmentID]
+		if !ok || (len(filter.SegmentSlugs) > 0 && !containsString(filter.SegmentSlugs, segment.Slug)) {
+			continue
+		}
+		event := HistoryEvent{
+			ID:          entry.ID,
+			Slug:        segment.Slug,
+			Operation:   entry.Operation,
+			OperationAt: entry.OperationAt,
+			Actor:       entry.Actor,
+		}
+		if !entry.ExpiresAt.IsZero() {
+			expiresAt := entry.ExpiresAt
+			event.ExpiresAt = &expiresAt
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].OperationAt.Equal(events[j].OperationAt) {
+			return events[i].OperationAt.Before(events[j].OperationAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	if filter.AfterID != 0 {
+		start := sort.Search(len(events), func(i int) bool {
+			if !events[i].OperationAt.Equal(filter.AfterOperationAt) {
+				return events[i].OperationAt.After(filter.AfterOperationAt)
+			}
+			return events[i].ID > filter.AfterID
+		})
+		events = events[start:]
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (m *Memory) GetHistory(ctx context.Context, filter HistoryFilter) ([]GetHistory, error) {
+	m.lock()
+	defer m.unlock()
+
+	userIds := map[uuid.UUID]bool{}
+	for _, userId := range filter.UserIDs {
+		userIds[userId] = true
+	}
+	entries := []GetHistory{}
+	for _, history := range m.state.history {
+		if !filter.From.IsZero() && history.OperationAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !history.OperationAt.Before(filter.To) {
+			continue
+		}
+		if (len(userIds) > 0 && !userIds[history.UserID]) || (filter.Operation != "" && history.Operation != filter.Operation) {
+			continue
+		}
+		segment, ok := m.state.segments[history.SegmentID]
+		if !ok || (len(filter.SegmentSlugs) > 0 && !containsString(filter.SegmentSlugs, segment.Slug)) {
+			continue
+		}
+		entries = append(entries, GetHistory{
+			UserID:      history.UserID,
+			Operation:   history.Operation,
+			OperationAt: history.OperationAt,
+			Slug:        segment.Slug,
+			Description: segment.Description,
+			Owner:       segment.Owner,
+			Tags:        segment.Tags,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].OperationAt.Before(entries[j].OperationAt)
+	})
+	return entries, nil
+}
+
+func (m *Memory) StreamHistory(ctx context.Context, filter HistoryFilter, batchSize int, fn func(entries []GetHistory) error) error {
+	// entries are selected at once, like Sql cursor sees single snapshot
+	entries, err := m.GetHistory(ctx, filter)
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		// like Sql fetch, cancelled request stops streaming between batches
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := entries
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		err = fn(batch)
+		if err != nil {
+			return err
+		}
+		entries = entries[len(batch):]
+	}
+	return nil
+}
+
+func (m *Memory) DropExpiredSegments(ctx context.Context, timeNow time.Time, limit int) (int, error) {
+	m.lock()
+	defer m.unlock()
+
+	dropped := m.state.dropExpired(timeNow, limit, func(key assignmentKey) bool {
+		return true
+	})
+	return dropped, nil
+}
+
+func (m *Memory) DropExpiredUserSegments(ctx context.Context, userId uuid.UUID, timeNow time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	m.state.dropExpired(timeNow, 0, func(key assignmentKey) bool {
+		return key.userId == userId
+	})
+	return nil
+}
+
+func (m *Memory) NextExpiration(ctx context.Context) (time.Time, error) {
+	m.lock()
+	defer m.unlock()
+
+	var next time.Time
+	for _, assignment := range m.state.assignments {
+		if assignment.DeleteAt.IsZero() {
+			continue
+		}
+		if next.IsZero() || assignment.DeleteAt.Before(next) {
+			next = assignment.DeleteAt
+		}
+	}
+	return next, nil
+}
@@ -0,0 +1,13 @@
+package db_test
+
+import (
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"github.com/nazarovlex/AVITO_TASK/internal/db/dbtest"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.Database {
+		return db.NewMemory()
+	})
+}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockKey is postgres advisory lock key which serializes migrations of concurrent replicas
+const migrationsLockKey = 4723101
+
+var ErrSchemaAhead = errors.New("database schema is ahead of the binary")
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Unknown is set for migrations applied by newer binary
+	Unknown bool
+}
+
+type SchemaMigrations struct {
+	tableName struct{}  `pg:"schema_migrations"`
+	Version   int64     `pg:"version,pk"`
+	Name      string    `pg:"name"`
+	AppliedAt time.Time `pg:"applied_at"`
+}
+
+// LoadMigrations parses embedded migrations/<version>_<name>.<up|down>.sql files sorted by version
+func LoadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		filename := entry.Name()
+		base := strings.TrimSuffix(filename, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration filename %s", filename)
+		}
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", filename, err)
+		}
+		content, err := migrationFiles.ReadFile("migrations/" + filename)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		} else if migration.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d has different names %s and %s", version, migration.Name, parts[1])
+		}
+		if direction == ".up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+type Migrator struct {
+	db         *pg.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *pg.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// withLock runs fn on single connection holding migrations advisory lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pg.Conn) error) error {
+	conn := m.db.Conn()
+	defer conn.Close()
+
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", migrationsLockKey)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(?)", migrationsLockKey)
+
+	_, err = conn.ExecContext(ctx, `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version bigint PRIMARY KEY,
+        name text NOT NULL,
+        applied_at timestamptz NOT NULL DEFAULT now()
+    )
+`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *pg.Conn) ([]SchemaMigrations, error) {
+	var applied []SchemaMigrations
+	err := conn.ModelContext(ctx, &applied).Order("version").Select()
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (m *Migrator) latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) checkAhead(applied []SchemaMigrations) error {
+	for _, migration := range applied {
+		if migration.Version > m.latest() {
+			return fmt.Errorf("%w: applied migration %d_%s, latest known %d", ErrSchemaAhead, migration.Version, migration.Name, m.latest())
+		}
+	}
+	return nil
+}
+
+// Up applies all pending migrations, each one in its own transaction
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pg.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		err = m.checkAhead(applied)
+		if err != nil {
+			return err
+		}
+
+		done := map[int64]bool{}
+		for _, migration := range applied {
+			done[migration.Version] = true
+		}
+		for _, migration := range m.migrations {
+			if done[migration.Version] {
+				continue
+			}
+			migration := migration
+			err = conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Up)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ModelContext(ctx, &SchemaMigrations{
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now(),
+				}).Insert()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the latest applied migration
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pg.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		err = m.checkAhead(applied)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return nil
+		}
+
+		last := applied[len(applied)-1]
+		for _, migration := range m.migrations {
+			if migration.Version != last.Version {
+				continue
+			}
+			err = conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Down)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ModelContext(ctx, &last).WherePK().Delete()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("migration %d_%s is unknown", last.Version, last.Name)
+	})
+}
+
+// Status returns all known and applied migrations sorted by version
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *pg.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		byVersion := map[int64]SchemaMigrations{}
+		for _, migration := range applied {
+			byVersion[migration.Version] = migration
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{
+				Version: migration.Version,
+				Name:    migration.Name,
+			}
+			done, ok := byVersion[migration.Version]
+			if ok {
+				status.Applied = true
+				status.AppliedAt = done.AppliedAt
+				delete(byVersion, migration.Version)
+			}
+			statuses = append(statuses, status)
+		}
+		for _, migration := range byVersion {
+			statuses = append(statuses, MigrationStatus{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Applied:   true,
+				AppliedAt: migration.AppliedAt,
+				Unknown:   true,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Check returns error if database schema doesn't match migrations known to the binary
+func (m *Migrator) Check(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.Unknown {
+			return fmt.Errorf("%w: applied migration %d_%s, latest known %d", ErrSchemaAhead, status.Version, status.Name, m.latest())
+		}
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			return fmt.Errorf("database schema is behind the binary: migration %d_%s is not applied", status.Version, status.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations loaded")
+	}
+	for i, migration := range migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("migration %s has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if strings.TrimSpace(migration.Up) == "" || strings.TrimSpace(migration.Down) == "" {
+			t.Fatalf("migration %d_%s has empty up or down", migration.Version, migration.Name)
+		}
+		// go-pg treats ? as query placeholder
+		if strings.Contains(migration.Up, "?") || strings.Contains(migration.Down, "?") {
+			t.Fatalf("migration %d_%s contains ? placeholder", migration.Version, migration.Name)
+		}
+	}
+}
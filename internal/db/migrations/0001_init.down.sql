@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS user_segment_history;
+DROP TABLE IF EXISTS segment_assignments;
+DROP TABLE IF EXISTS segments;
+DROP TABLE IF EXISTS users;
+DROP TYPE IF EXISTS operation;
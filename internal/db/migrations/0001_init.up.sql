@@ -0,0 +1,36 @@
+-- baseline schema, previously created on startup by CreateEnumType, CreateSchema and CreateIndexes
+DO $$ BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'operation') THEN
+        CREATE TYPE operation AS ENUM ('добавление', 'удаление');
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS users (
+    id uuid PRIMARY KEY,
+    name text
+);
+
+CREATE TABLE IF NOT EXISTS segments (
+    id uuid PRIMARY KEY,
+    slug text UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS segment_assignments (
+    user_id uuid,
+    segment_id uuid,
+    delete_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS user_segment_history (
+    user_id uuid,
+    segment_id uuid,
+    operation operation,
+    operation_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_id ON users (id);
+CREATE INDEX IF NOT EXISTS idx_segment_id ON segments (id);
+CREATE INDEX IF NOT EXISTS idx_segment_slug ON segments (slug);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_segment ON segment_assignments (user_id, segment_id);
+CREATE INDEX IF NOT EXISTS idx_delete_at ON segment_assignments (delete_at);
+CREATE INDEX IF NOT EXISTS idx_user_id_history ON user_segment_history (user_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_segment_percent;
+
+ALTER TABLE segments DROP COLUMN IF EXISTS salt;
+ALTER TABLE segments DROP COLUMN IF EXISTS percent;
@@ -0,0 +1,7 @@
+-- percentage rollout settings, tables created before could miss these columns
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS percent integer NOT NULL DEFAULT 0;
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS salt text;
+
+UPDATE segments SET salt = id::text WHERE salt IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_segment_percent ON segments (percent) WHERE percent > 0;
@@ -0,0 +1,6 @@
+DELETE FROM user_segment_history WHERE operation = 'истечение';
+
+ALTER TYPE operation RENAME TO operation_old;
+CREATE TYPE operation AS ENUM ('добавление', 'удаление');
+ALTER TABLE user_segment_history ALTER COLUMN operation TYPE operation USING operation::text::operation;
+DROP TYPE operation_old;
@@ -0,0 +1,2 @@
+-- automatic ttl expirations are recorded in history separately from manual removals
+ALTER TYPE operation ADD VALUE IF NOT EXISTS 'истечение';
@@ -0,0 +1,4 @@
+-- identifier of the user in other systems, e.g. account number
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_external_id ON users (external_id);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_segment_user;
+DROP INDEX IF EXISTS idx_user_name_id;
+
+ALTER TABLE users ALTER COLUMN name DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN name DROP DEFAULT;
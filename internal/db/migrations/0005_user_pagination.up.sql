@@ -0,0 +1,10 @@
+-- empty names were stored as NULL, which breaks keyset comparison by name
+UPDATE users SET name = '' WHERE name IS NULL;
+ALTER TABLE users ALTER COLUMN name SET DEFAULT '';
+ALTER TABLE users ALTER COLUMN name SET NOT NULL;
+
+-- keyset pagination of users by name and name prefix search, C collation makes it usable for LIKE
+CREATE INDEX IF NOT EXISTS idx_user_name_id ON users ((name COLLATE "C"), id);
+
+-- members of segment lookup
+CREATE INDEX IF NOT EXISTS idx_segment_user ON segment_assignments (segment_id, user_id);
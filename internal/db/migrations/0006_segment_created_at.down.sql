@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_segment_slug_c;
+
+ALTER TABLE segments DROP COLUMN IF EXISTS created_at;
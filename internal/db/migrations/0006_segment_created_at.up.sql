@@ -0,0 +1,5 @@
+-- segments created before this migration get migration time as creation time
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+
+-- keyset pagination of segments by slug in byte order
+CREATE INDEX IF NOT EXISTS idx_segment_slug_c ON segments ((slug COLLATE "C"));
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_segment_tags;
+DROP INDEX IF EXISTS idx_segment_owner;
+
+ALTER TABLE segments DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE segments DROP COLUMN IF EXISTS tags;
+ALTER TABLE segments DROP COLUMN IF EXISTS owner;
+ALTER TABLE segments DROP COLUMN IF EXISTS description;
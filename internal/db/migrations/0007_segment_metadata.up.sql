@@ -0,0 +1,10 @@
+-- what the segment is for and which team owns it
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS owner text NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+UPDATE segments SET updated_at = created_at;
+
+CREATE INDEX IF NOT EXISTS idx_segment_owner ON segments (owner);
+CREATE INDEX IF NOT EXISTS idx_segment_tags ON segments USING gin (tags);
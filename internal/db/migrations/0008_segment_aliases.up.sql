@@ -0,0 +1,8 @@
+-- previous slugs of renamed segments, they resolve to the segment until expires_at
+CREATE TABLE IF NOT EXISTS segment_aliases (
+    slug text PRIMARY KEY,
+    segment_id uuid NOT NULL REFERENCES segments (id) ON DELETE CASCADE,
+    expires_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_segment_alias_segment ON segment_aliases (segment_id);
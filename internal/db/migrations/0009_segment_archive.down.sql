@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_segment_archived_at;
+ALTER TABLE segments DROP COLUMN IF EXISTS archived_at;
@@ -0,0 +1,7 @@
+-- archived segments are kept for history and reports, they have no members and can't be assigned
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS archived_at timestamptz;
+
+-- assignments left behind by segments deleted before soft delete
+DELETE FROM segment_assignments WHERE segment_id NOT IN (SELECT id FROM segments);
+
+CREATE INDEX IF NOT EXISTS idx_segment_archived_at ON segments (archived_at) WHERE archived_at IS NOT NULL;
@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS idx_segment_id_history;
+
+ALTER TABLE user_segment_history
+    DROP CONSTRAINT IF EXISTS fk_user_segment_history_segment,
+    DROP CONSTRAINT IF EXISTS fk_user_segment_history_user;
+
+ALTER TABLE segment_assignments
+    DROP CONSTRAINT IF EXISTS fk_segment_assignments_segment,
+    DROP CONSTRAINT IF EXISTS fk_segment_assignments_user;
+
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,20 @@
+-- deleted users are kept to keep their history, erased users are deleted together with personal data
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+
+-- orphans of users and segments deleted before foreign keys, history of deleted users is anonymized
+DELETE FROM segment_assignments WHERE user_id NOT IN (SELECT id FROM users) OR segment_id NOT IN (SELECT id FROM segments);
+DELETE FROM user_segment_history WHERE segment_id NOT IN (SELECT id FROM segments);
+UPDATE user_segment_history SET user_id = NULL WHERE user_id NOT IN (SELECT id FROM users);
+
+-- assignments live only as long as both user and segment, purged segments take history with them,
+-- history of erased users stays anonymous
+ALTER TABLE segment_assignments
+    ADD CONSTRAINT fk_segment_assignments_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    ADD CONSTRAINT fk_segment_assignments_segment FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE;
+
+ALTER TABLE user_segment_history
+    ADD CONSTRAINT fk_user_segment_history_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL,
+    ADD CONSTRAINT fk_user_segment_history_segment FOREIGN KEY (segment_id) REFERENCES segments (id) ON DELETE CASCADE;
+
+-- cascades of segment deletion
+CREATE INDEX IF NOT EXISTS idx_segment_id_history ON user_segment_history (segment_id);
@@ -0,0 +1,2 @@
+ALTER TABLE user_segment_history DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE user_segment_history DROP COLUMN IF EXISTS id;
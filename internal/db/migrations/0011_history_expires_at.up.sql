@@ -0,0 +1,19 @@
+-- order of history entries with the same operation time
+ALTER TABLE user_segment_history ADD COLUMN IF NOT EXISTS id bigserial PRIMARY KEY;
+
+-- ttl set by addition, membership at any instant is restored from history even before expiration is recorded
+ALTER TABLE user_segment_history ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+
+-- expiration is known only for current assignments, earlier additions already ended with recorded removal or expiration
+UPDATE user_segment_history h
+SET expires_at = sa.delete_at
+FROM segment_assignments sa
+WHERE sa.user_id = h.user_id
+AND sa.segment_id = h.segment_id
+AND h.id = (
+    SELECT max(last.id)
+    FROM user_segment_history last
+    WHERE last.user_id = h.user_id
+    AND last.segment_id = h.segment_id
+    AND last.operation = 'добавление'
+);
@@ -0,0 +1 @@
+ALTER TABLE user_segment_history DROP COLUMN IF EXISTS actor;
@@ -0,0 +1,5 @@
+-- who made the change: X-Actor header of the request, system for rollout and expiration, empty if unknown
+ALTER TABLE user_segment_history ADD COLUMN IF NOT EXISTS actor text NOT NULL DEFAULT '';
+
+-- expirations were always made by the runner
+UPDATE user_segment_history SET actor = 'system' WHERE operation = 'истечение';
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_operation_at_history;
@@ -0,0 +1,2 @@
+-- reports select history by operation time range
+CREATE INDEX IF NOT EXISTS idx_operation_at_history ON user_segment_history (operation_at);
@@ -0,0 +1,3 @@
+-- fails if external id of deleted user was reused
+DROP INDEX IF EXISTS idx_user_external_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_external_id ON users (external_id);
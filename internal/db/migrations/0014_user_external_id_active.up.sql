@@ -0,0 +1,3 @@
+-- external id of deleted user can be taken by new user, deleted users keep it for history
+DROP INDEX IF EXISTS idx_user_external_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_external_id ON users (external_id) WHERE deleted_at IS NULL;
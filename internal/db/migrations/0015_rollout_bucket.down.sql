@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS rollout_bucket(uuid, text);
@@ -0,0 +1,13 @@
+-- same bucket as RolloutBucket in go: 32-bit FNV-1a hash of salt and user id bytes modulo 100,
+-- so rollout can be enrolled by single statement
+CREATE OR REPLACE FUNCTION rollout_bucket(user_id uuid, salt text) RETURNS integer AS $$
+DECLARE
+    data bytea := convert_to(salt, 'UTF8') || uuid_send(user_id);
+    hash bigint := 2166136261;
+BEGIN
+    FOR i IN 0 .. length(data) - 1 LOOP
+        hash := ((hash # get_byte(data, i)) * 16777619) % 4294967296;
+    END LOOP;
+    RETURN hash % 100;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE STRICT PARALLEL SAFE;
@@ -1,7 +1,6 @@
 package db
 
 import (
-	"context"
 	"github.com/google/uuid"
 	"time"
 )
@@ -11,7 +10,11 @@ import (
 type Users struct {
 	tableName struct{}  `pg:"users"`
 	ID        uuid.UUID `pg:"id,pk,type:uuid" json:"id"`
-	Name      string    `pg:"name" json:"name"`
+	Name      string    `pg:"name,use_zero" json:"name"`
+	// ExternalID is optional unique id of the user in other systems, empty value is stored as NULL
+	ExternalID string `pg:"external_id" json:"external_id,omitempty"`
+	// DeletedAt is set for deleted users, they are kept only for history
+	DeletedAt *time.Time `pg:"deleted_at" json:"deleted_at,omitempty"`
 }
 
 type SegmentAssignments struct {
@@ -25,46 +28,188 @@ type Segments struct {
 	tableName struct{}  `pg:"segments"`
 	ID        uuid.UUID `pg:"id,pk,type:uuid" json:"id"`
 	Slug      string    `pg:"slug,unique" json:"slug" `
+	Percent   int       `pg:"percent,notnull,use_zero" json:"percent"`
+	Salt      string    `pg:"salt" json:"-"`
+	// Description and Owner are free text, Owner is usually name of the team
+	Description string    `pg:"description,use_zero" json:"description"`
+	Owner       string    `pg:"owner,use_zero" json:"owner"`
+	Tags        []string  `pg:"tags,array,use_zero" json:"tags"`
+	CreatedAt   time.Time `pg:"created_at,default:now()" json:"created_at"`
+	UpdatedAt   time.Time `pg:"updated_at,default:now()" json:"updated_at"`
+	// ArchivedAt is set for archived segments, they have no members and can't be assigned to users
+	ArchivedAt *time.Time `pg:"archived_at" json:"archived_at,omitempty"`
+}
+
+func (s Segments) Archived() bool {
+	return s.ArchivedAt != nil
+}
+
+// SegmentAliases keep previous slugs of renamed segments resolvable until ExpiresAt
+type SegmentAliases struct {
+	tableName struct{}  `pg:"segment_aliases"`
+	Slug      string    `pg:"slug,pk"`
+	SegmentID uuid.UUID `pg:"segment_id,type:uuid"`
+	ExpiresAt time.Time `pg:"expires_at"`
 }
 
 type UserSegmentHistory struct {
 	tableName   struct{}  `pg:"user_segment_history"`
+	ID          int64     `pg:"id,pk"`
 	UserID      uuid.UUID `pg:"user_id,type:uuid"`
 	SegmentID   uuid.UUID `pg:"segment_id,type:uuid"`
 	Operation   string    `pg:"operation,type:operation"`
 	OperationAt time.Time `pg:"operation_at"`
+	// ExpiresAt is ttl expiration of added segment, zero time means that segment never expires
+	ExpiresAt time.Time `pg:"expires_at"`
+	// Actor made the change, ActorSystem for rollout and expiration, empty if unknown
+	Actor string `pg:"actor,use_zero"`
 }
 
+// user_segment_history.operation values
+
+const (
+	OperationAdd    = "добавление"
+	OperationDelete = "удаление"
+	OperationExpire = "истечение"
+)
+
 // db response models
 
 type GetHistory struct {
+	// UserID is nil for history of erased users
 	UserID      uuid.UUID `pg:"user_id,type:uuid"`
 	Operation   string    `pg:"operation"`
 	OperationAt time.Time `pg:"operation_at"`
 	Slug        string    `pg:"slug"`
+	Description string    `pg:"description"`
+	Owner       string    `pg:"owner"`
+	Tags        []string  `pg:"tags,array"`
+}
+
+// HistoryFilter selects history entries of report, zero values mean no filtering
+type HistoryFilter struct {
+	// From is inclusive and To is exclusive bound of operation time
+	From time.Time
+	To   time.Time
+	// SegmentSlugs selects entries of segments with current slugs
+	SegmentSlugs []string
+	UserIDs      []uuid.UUID
+	Operation    string
 }
 
 type UserWithSegments struct {
-	UserID       uuid.UUID `pg:"user_id,type:uuid"`
-	SegmentSlugs []string  `pg:"segment_slugs,type:text[]"`
+	UserID       uuid.UUID `pg:"user_id,type:uuid" json:"user_id"`
+	Name         string    `pg:"name" json:"name"`
+	ExternalID   string    `pg:"external_id" json:"external_id,omitempty"`
+	SegmentSlugs []string  `pg:"segment_slugs,type:text[]" json:"segment_slugs"`
 }
 
-// create all models if not exist
+// user listing sort orders
+
+const (
+	UsersSortID   = "id"
+	UsersSortName = "name"
+)
 
-func CreateSchema(ctx context.Context, dbService *Service) error {
-	models := []interface{}{
-		(*Users)(nil),
-		(*Segments)(nil),
-		(*SegmentAssignments)(nil),
-		(*UserSegmentHistory)(nil),
-	}
+// UsersFilter selects page of users, zero values mean no filtering
+type UsersFilter struct {
+	// Limit is max number of returned users, 0 means no limit
+	Limit int
+	Sort  string
+	// AfterID and AfterName are taken from the last user of previous page, nil AfterID means first page
+	AfterID     uuid.UUID
+	AfterName   string
+	SegmentSlug string
+	NamePrefix  string
+	NoSegments  bool
+}
 
-	for _, model := range models {
-		err := dbService.CreateTable(ctx, model)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+type UsersPage struct {
+	Users      []UserWithSegments `json:"users"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+type SegmentDetails struct {
+	ID          uuid.UUID  `pg:"id,type:uuid" json:"id"`
+	Slug        string     `pg:"slug" json:"slug"`
+	Percent     int        `pg:"percent" json:"percent"`
+	Description string     `pg:"description" json:"description"`
+	Owner       string     `pg:"owner" json:"owner"`
+	Tags        []string   `pg:"tags,array" json:"tags"`
+	CreatedAt   time.Time  `pg:"created_at" json:"created_at"`
+	UpdatedAt   time.Time  `pg:"updated_at" json:"updated_at"`
+	ArchivedAt  *time.Time `pg:"archived_at" json:"archived_at,omitempty"`
+	MemberCount int        `pg:"member_count" json:"member_count"`
+}
+
+// SegmentsFilter selects page of segments sorted by slug, zero values mean no filtering
+type SegmentsFilter struct {
+	// Limit is max number of returned segments, 0 means no limit
+	Limit int
+	// AfterSlug is slug of the last segment of previous page, empty means first page
+	AfterSlug string
+	// Search is case insensitive substring of slug
+	Search string
+	Owner  string
+	// Tag selects segments which have the tag
+	Tag string
+	// Archived selects archived segments instead of active ones
+	Archived bool
+}
+
+type SegmentsPage struct {
+	Segments   []SegmentDetails `json:"segments"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+type SegmentMember struct {
+	UserID     uuid.UUID `pg:"user_id,type:uuid" json:"user_id"`
+	Name       string    `pg:"name" json:"name"`
+	ExternalID string    `pg:"external_id" json:"external_id,omitempty"`
+	// ExpiresAt is nil if segment never expires for the user
+	ExpiresAt *time.Time `pg:"delete_at" json:"expires_at"`
+}
+
+type SegmentMembersPage struct {
+	Members    []SegmentMember `json:"members"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// UserSegment is segment which user was in at some instant
+type UserSegment struct {
+	Slug    string    `pg:"slug" json:"slug"`
+	AddedAt time.Time `pg:"added_at" json:"added_at"`
+	// ExpiresAt is nil if segment never expires for the user
+	ExpiresAt *time.Time `pg:"expires_at" json:"expires_at"`
+}
+
+// HistoryEvent is addition or removal of segment in history of single user
+type HistoryEvent struct {
+	ID          int64     `pg:"id" json:"id"`
+	Slug        string    `pg:"slug" json:"slug"`
+	Operation   string    `pg:"operation" json:"operation"`
+	OperationAt time.Time `pg:"operation_at" json:"operation_at"`
+	// ExpiresAt and TTLHours are ttl set by addition, they are empty if segment never expires
+	ExpiresAt *time.Time `pg:"expires_at" json:"expires_at,omitempty"`
+	TTLHours  int        `pg:"-" json:"ttl_hours,omitempty"`
+	Actor     string     `pg:"actor" json:"actor"`
+}
+
+// UserHistoryFilter selects page of user history sorted by operation time, zero values mean no filtering
+type UserHistoryFilter struct {
+	// Limit is max number of returned events, 0 means no limit
+	Limit int
+	// AfterID and AfterOperationAt are taken from the last event of previous page, zero AfterID means first page
+	AfterID          int64
+	AfterOperationAt time.Time
+	// From is inclusive and To is exclusive bound of operation time
+	From time.Time
+	To   time.Time
+	// SegmentSlugs selects events of segments with current slugs
+	SegmentSlugs []string
+}
 
+type UserHistoryPage struct {
+	Events     []HistoryEvent `json:"events"`
+	NextCursor string         `json:"next_cursor,omitempty"`
 }
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"github.com/google/uuid"
+	"hash/fnv"
+)
+
+// RolloutBucket returns stable bucket in range [0, 100) for user inside segment with given salt
+func RolloutBucket(userId uuid.UUID, salt string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(salt))
+	_, _ = hash.Write(userId[:])
+	return int(hash.Sum32() % 100)
+}
+
+// InRollout reports whether user falls into segment rollout percentage
+func (s Segments) InRollout(userId uuid.UUID) bool {
+	if s.Percent <= 0 {
+		return false
+	}
+	return RolloutBucket(userId, s.Salt) < s.Percent
+}
@@ -2,81 +2,179 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultAliasTTL is how long previous slug of renamed segment keeps resolving to the segment
+const DefaultAliasTTL = 30 * 24 * time.Hour
+
 type Service struct {
-	db Database
+	db             Database
+	aliasTTL       time.Duration
+	reportLocation *time.Location
 }
 
 func NewService(db Database) *Service {
 	return &Service{
-		db: db,
+		db:             db,
+		aliasTTL:       DefaultAliasTTL,
+		reportLocation: time.UTC,
 	}
 }
 
+// SetAliasTTL sets how long previous slugs of renamed segments are resolved
+func (s *Service) SetAliasTTL(ttl time.Duration) {
+	s.aliasTTL = ttl
+}
+
+// SetReportLocation sets time zone of report month boundaries and report times
+func (s *Service) SetReportLocation(location *time.Location) {
+	s.reportLocation = location
+}
+
+func (s *Service) ReportLocation() *time.Location {
+	return s.reportLocation
+}
+
 type Database interface {
-	//  postgres config
-	CreateEnumType(ctx context.Context) error
-	CreateTable(ctx context.Context, model interface{}) error
-	CreateIndexes(ctx context.Context) error
+	// transactions
+	RunInTransaction(ctx context.Context, fn func(tx Database) error) error
 
-	// user
-	FetchUsers(ctx context.Context) ([]UserWithSegments, error)
+	// user, deleted users are kept only for history and are not returned by any method
+	FetchUsers(ctx context.Context, filter UsersFilter) ([]UserWithSegments, error)
 	FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegments, error)
-	CreateUser(ctx context.Context, name string) error
-	DeleteUser(ctx context.Context, userId uuid.UUID) error
+	FetchUserByExternalID(ctx context.Context, externalId string) (Users, error)
+	CreateUser(ctx context.Context, user Users) (Users, error)
+	DeleteUser(ctx context.Context, userId uuid.UUID, deletedAt time.Time) error
+	// EraseUser permanently deletes user, deleted or not, with assignments and anonymizes its history
+	EraseUser(ctx context.Context, userId uuid.UUID) error
 
 	// segments
-	CreateSegment(ctx context.Context, slug string) error
+	CreateSegment(ctx context.Context, segment Segments) (Segments, error)
+	// FetchSegment finds segment by current slug or by not expired alias
 	FetchSegment(ctx context.Context, slug string) (Segments, error)
+	FetchSegmentDetails(ctx context.Context, slug string) (SegmentDetails, error)
+	FetchSegments(ctx context.Context, filter SegmentsFilter) ([]SegmentDetails, error)
+	// FetchSegmentMembers returns active members of segment sorted by user id, 0 limit means no limit
+	FetchSegmentMembers(ctx context.Context, segmentId, afterUserId uuid.UUID, limit int) ([]SegmentMember, error)
+	// FetchRolloutSegments returns not archived segments with percent > 0
+	FetchRolloutSegments(ctx context.Context) ([]Segments, error)
 	UpdateSegment(ctx context.Context, segment Segments) error
+	// DeleteSegment permanently deletes segment with its assignments, aliases and history
 	DeleteSegment(ctx context.Context, slug string) error
+	// SaveSegmentAlias creates alias or replaces existing alias with the same slug
+	SaveSegmentAlias(ctx context.Context, alias SegmentAliases) error
+	DeleteSegmentAlias(ctx context.Context, slug string) error
 
 	// adding and deleting user segments
-	CheckExistedUser(ctx context.Context, userId uuid.UUID) bool
+	FetchUserIDs(ctx context.Context) ([]uuid.UUID, error)
+	// CheckExistedUser reports whether user exists and is not deleted
+	CheckExistedUser(ctx context.Context, userId uuid.UUID) (bool, error)
 	AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID, expirationTime time.Time) error
 	DeleteUserSegments(ctx context.Context, userId, segmentId uuid.UUID) error
+	// RemoveSegmentAssignments removes segment from all its members and records removals made by actor in history
+	RemoveSegmentAssignments(ctx context.Context, segmentId uuid.UUID, operatedAt time.Time, actor string) error
+	// RemoveUserAssignments removes all segments of user and records removals made by actor in history
+	RemoveUserAssignments(ctx context.Context, userId uuid.UUID, operatedAt time.Time, actor string) error
+	// EnrollRollout adds never expiring segment to active users which RolloutBucket falls into segment percent
+	// and records additions made by actor in history
+	EnrollRollout(ctx context.Context, segment Segments, operatedAt time.Time, actor string) error
 
 	// history
-	SaveHistory(ctx context.Context, userId, segmentId uuid.UUID, operation string, operatedAt time.Time) error
-	GetHistory(ctx context.Context, year, month int) ([]GetHistory, error)
+	SaveHistory(ctx context.Context, entry UserSegmentHistory) error
+	// FetchUserSegmentsAt restores segments which user was in at the instant from history sorted by slug
+	FetchUserSegmentsAt(ctx context.Context, userId uuid.UUID, at time.Time) ([]UserSegment, error)
+	// FetchUserHistory returns events of user sorted by operation time and id, ttl hours are not filled
+	FetchUserHistory(ctx context.Context, userId uuid.UUID, filter UserHistoryFilter) ([]HistoryEvent, error)
+	// GetHistory returns history entries matching filter sorted by operation time
+	GetHistory(ctx context.Context, filter HistoryFilter) ([]GetHistory, error)
+	// StreamHistory passes entries of GetHistory to fn in batches of batchSize without loading all of them into memory
+	StreamHistory(ctx context.Context, filter HistoryFilter, batchSize int, fn func(entries []GetHistory) error) error
 
-	// runner
-	DropExpiredSegments(ctx context.Context, timeNow time.Time) error
+	// expiration, assignments with delete_at <= now are treated as already removed by all read queries
+	DropExpiredSegments(ctx context.Context, timeNow time.Time, limit int) (int, error)
+	DropExpiredUserSegments(ctx context.Context, userId uuid.UUID, timeNow time.Time) error
+	NextExpiration(ctx context.Context) (time.Time, error)
 }
 
-func (s *Service) CreateEnumType(ctx context.Context) error {
-	err := s.db.CreateEnumType(ctx)
-	if err != nil {
-		return err
-	}
-	return nil
+// WithTx runs fn inside single database transaction, all changes made through tx are rolled back if fn returns error
+func (s *Service) WithTx(ctx context.Context, fn func(tx *Service) error) error {
+	return s.db.RunInTransaction(ctx, func(tx Database) error {
+		txService := *s
+		txService.db = tx
+		return fn(&txService)
+	})
 }
 
-func (s *Service) CreateTable(ctx context.Context, model interface{}) error {
-	err := s.db.CreateTable(ctx, model)
-	if err != nil {
-		return err
+// page size limits of users listing
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// pageLimit replaces zero limit with default page size and validates it
+func pageLimit(limit int, details *[]FieldError) int {
+	if limit == 0 {
+		return DefaultPageSize
 	}
-	return nil
+	if limit < 0 || limit > MaxPageSize {
+		*details = append(*details, FieldError{Field: "limit", Value: fmt.Sprint(limit), Message: fmt.Sprintf("must be in range from 1 to %d", MaxPageSize)})
+	}
+	return limit
 }
 
-func (s *Service) CreateIndexes(ctx context.Context) error {
-	err := s.db.CreateIndexes(ctx)
+// FetchUsers returns page of users which starts after cursor, zero filter limit means default page size
+func (s *Service) FetchUsers(ctx context.Context, filter UsersFilter, cursor string) (UsersPage, error) {
+	var details []FieldError
+	filter.Limit = pageLimit(filter.Limit, &details)
+	if filter.Sort == "" {
+		filter.Sort = UsersSortID
+	}
+	if filter.Sort != UsersSortID && filter.Sort != UsersSortName {
+		details = append(details, FieldError{Field: "sort", Value: filter.Sort, Message: "must be id or name"})
+	}
+	if filter.NoSegments && filter.SegmentSlug != "" {
+		details = append(details, FieldError{Field: "no_segments", Message: "can't be combined with segment filter"})
+	}
+	after, err := DecodeCursor(cursor)
 	if err != nil {
-		return err
+		return UsersPage{}, err
+	}
+	if after.ID != "" {
+		filter.AfterID, err = uuid.Parse(after.ID)
+		if err != nil {
+			details = append(details, FieldError{Field: "cursor", Value: cursor, Message: "malformed cursor"})
+		}
+		filter.AfterName = after.Key
+	}
+	if len(details) > 0 {
+		return UsersPage{}, &Error{Kind: ErrValidation, Message: "invalid users filter", Details: details}
 	}
-	return nil
-}
 
-func (s *Service) FetchUsers(ctx context.Context) ([]UserWithSegments, error) {
-	fetched, err := s.db.FetchUsers(ctx)
+	// one extra user tells whether there is next page
+	limit := filter.Limit
+	filter.Limit++
+	users, err := s.db.FetchUsers(ctx, filter)
 	if err != nil {
-		return []UserWithSegments{}, err
+		return UsersPage{}, err
 	}
-	return fetched, nil
+	page := UsersPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		last := page.Users[limit-1]
+		next := Cursor{ID: last.UserID.String()}
+		if filter.Sort == UsersSortName {
+			next.Key = last.Name
+		}
+		page.NextCursor = next.Encode()
+	}
+	return page, nil
 }
 
 func (s *Service) FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegments, error) {
@@ -87,28 +185,269 @@ func (s *Service) FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegm
 	return fetched, nil
 }
 
-func (s *Service) CreateUser(ctx context.Context, name string) error {
-	err := s.db.CreateUser(ctx, name)
+func (s *Service) FetchUserByExternalID(ctx context.Context, externalId string) (Users, error) {
+	user, err := s.db.FetchUserByExternalID(ctx, externalId)
 	if err != nil {
-		return err
+		return Users{}, err
 	}
-	return nil
+	return user, nil
 }
 
-func (s *Service) DeleteUser(ctx context.Context, userId uuid.UUID) error {
-	err := s.db.DeleteUser(ctx, userId)
+// CreateUser creates user and enrolls it into percentage segments which its hash bucket falls into.
+// Id is generated if user.ID is not set by the caller.
+func (s *Service) CreateUser(ctx context.Context, user Users) (Users, error) {
+	if user.ID == uuid.Nil {
+		user.ID = uuid.New()
+	}
+	// user created deleted would be hidden from every method and never get rollout segments
+	user.DeletedAt = nil
+	err := s.WithTx(ctx, func(tx *Service) error {
+		var err error
+		user, err = tx.db.CreateUser(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		segments, err := tx.db.FetchRolloutSegments(ctx)
+		if err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		for _, segment := range segments {
+			if !segment.InRollout(user.ID) {
+				continue
+			}
+			err = tx.db.AddUserSegments(ctx, user.ID, segment.ID, time.Time{})
+			if err != nil {
+				return err
+			}
+			err = tx.db.SaveHistory(ctx, UserSegmentHistory{
+				UserID:      user.ID,
+				SegmentID:   segment.ID,
+				Operation:   OperationAdd,
+				OperationAt: currentTime,
+				Actor:       ActorSystem,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return Users{}, err
 	}
-	return nil
+	return user, nil
+}
+
+// DeleteUser removes all segments of user with history records and marks user deleted, history of the user is kept
+func (s *Service) DeleteUser(ctx context.Context, userId uuid.UUID) error {
+	return s.WithTx(ctx, func(tx *Service) error {
+		err := tx.checkUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		currentTime := time.Now()
+		err = tx.db.RemoveUserAssignments(ctx, userId, currentTime, actorFrom(ctx))
+		if err != nil {
+			return err
+		}
+		return tx.db.DeleteUser(ctx, userId, currentTime)
+	})
+}
+
+// EraseUser permanently deletes personal data of user for privacy requests, history entries of the user stay anonymous.
+// Segments of not yet deleted user are removed with history records first.
+func (s *Service) EraseUser(ctx context.Context, userId uuid.UUID) error {
+	return s.WithTx(ctx, func(tx *Service) error {
+		exists, err := tx.db.CheckExistedUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err = tx.db.RemoveUserAssignments(ctx, userId, time.Now(), actorFrom(ctx))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.db.EraseUser(ctx, userId)
+	})
+}
+
+// normalizeTags drops empty and duplicate tags and sorts the rest, result is never nil
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return normalized
 }
 
-func (s *Service) CreateSegment(ctx context.Context, slug string) error {
-	err := s.db.CreateSegment(ctx, slug)
+// CreateSegment creates segment with given slug, rollout percent and metadata and enrolls given percent of existing users into it
+func (s *Service) CreateSegment(ctx context.Context, segment Segments) (Segments, error) {
+	if segment.Slug == "" {
+		return Segments{}, NewError(ErrValidation, "segment slug must not be empty")
+	}
+	if segment.Percent < 0 || segment.Percent > 100 {
+		return Segments{}, NewError(ErrValidation, "segment percent must be in range from 0 to 100, got %d", segment.Percent)
+	}
+	segment.ID = uuid.New()
+	segment.Salt = uuid.New().String()
+	segment.Tags = normalizeTags(segment.Tags)
+	segment.CreatedAt = time.Now()
+	segment.UpdatedAt = segment.CreatedAt
+	// archived segments must have no members, so new segment is always active
+	segment.ArchivedAt = nil
+	err := s.WithTx(ctx, func(tx *Service) error {
+		var err error
+		segment, err = tx.db.CreateSegment(ctx, segment)
+		if err != nil {
+			return err
+		}
+		// new segment takes the slug over from previous owner of the alias
+		err = tx.db.DeleteSegmentAlias(ctx, segment.Slug)
+		if err != nil {
+			return err
+		}
+		return tx.enrollRollout(ctx, segment)
+	})
 	if err != nil {
-		return err
+		return Segments{}, err
 	}
-	return nil
+	return segment, nil
+}
+
+// enrollRollout adds segment to existing users which hash bucket falls into segment percent
+func (s *Service) enrollRollout(ctx context.Context, segment Segments) error {
+	if segment.Percent == 0 {
+		return nil
+	}
+	return s.db.EnrollRollout(ctx, segment, time.Now(), ActorSystem)
+}
+
+// UpdateUserSegments removes and adds user segments in single transaction, segmentsToAdd maps slug to ttl in hours,
+// zero ttl means that segment never expires
+func (s *Service) UpdateUserSegments(ctx context.Context, userId uuid.UUID, segmentsToAdd map[string]int, segmentsToDelete []string) error {
+	slugsToAdd := make([]string, 0, len(segmentsToAdd))
+	for slug := range segmentsToAdd {
+		slugsToAdd = append(slugsToAdd, slug)
+	}
+	sort.Strings(slugsToAdd)
+
+	var details []FieldError
+	for _, slug := range slugsToAdd {
+		if segmentsToAdd[slug] < 0 {
+			details = append(details, FieldError{Field: "segments_to_add", Value: slug, Message: "ttl must not be negative"})
+		}
+	}
+	if len(details) > 0 {
+		return &Error{Kind: ErrValidation, Message: "invalid segments ttl", Details: details}
+	}
+
+	return s.WithTx(ctx, func(tx *Service) error {
+		err := tx.checkUser(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		// resolve all slugs first to report every unknown one at once
+		segments := map[string]Segments{}
+		var details []FieldError
+		resolve := func(field string, slugs []string) error {
+			for _, slug := range slugs {
+				segment, err := tx.db.FetchSegment(ctx, slug)
+				if errors.Is(err, ErrNotFound) {
+					details = append(details, FieldError{Field: field, Value: slug, Message: "unknown segment"})
+					continue
+				} else if err != nil {
+					return err
+				}
+				segments[slug] = segment
+			}
+			return nil
+		}
+		err = resolve("segment_to_delete", segmentsToDelete)
+		if err != nil {
+			return err
+		}
+		err = resolve("segments_to_add", slugsToAdd)
+		if err != nil {
+			return err
+		}
+		for _, slug := range slugsToAdd {
+			segment, ok := segments[slug]
+			if ok && segment.Archived() {
+				details = append(details, FieldError{Field: "segments_to_add", Value: slug, Message: "segment is archived"})
+			}
+		}
+		if len(details) > 0 {
+			return &Error{Kind: ErrValidation, Message: "unknown or archived segments", Details: details}
+		}
+
+		// drop expired but not yet cleaned up assignments, so they can be added again
+		currentTime := time.Now()
+		err = tx.db.DropExpiredUserSegments(ctx, userId, currentTime)
+		if err != nil {
+			return err
+		}
+
+		for _, slug := range segmentsToDelete {
+			segment := segments[slug]
+			err = tx.db.DeleteUserSegments(ctx, userId, segment.ID)
+			if err != nil {
+				return err
+			}
+			err = tx.db.SaveHistory(ctx, UserSegmentHistory{
+				UserID:      userId,
+				SegmentID:   segment.ID,
+				Operation:   OperationDelete,
+				OperationAt: currentTime,
+				Actor:       actorFrom(ctx),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, slug := range slugsToAdd {
+			segment := segments[slug]
+			var expirationTime time.Time
+			if ttl := segmentsToAdd[slug]; ttl > 0 {
+				expirationTime = currentTime.Add(time.Duration(ttl) * time.Hour)
+			}
+			err = tx.db.AddUserSegments(ctx, userId, segment.ID, expirationTime)
+			if errors.Is(err, ErrAlreadyExists) {
+				return &Error{
+					Kind:    ErrAlreadyExists,
+					Message: fmt.Sprintf("segment %s is already added to user %s", slug, userId),
+					Err:     err,
+					Details: []FieldError{{Field: "segments_to_add", Value: slug, Message: "segment is already added to user"}},
+				}
+			} else if err != nil {
+				return err
+			}
+			err = tx.db.SaveHistory(ctx, UserSegmentHistory{
+				UserID:      userId,
+				SegmentID:   segment.ID,
+				Operation:   OperationAdd,
+				OperationAt: currentTime,
+				ExpiresAt:   expirationTime,
+				Actor:       actorFrom(ctx),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (s *Service) FetchSegment(ctx context.Context, slug string) (Segments, error) {
@@ -119,25 +458,260 @@ func (s *Service) FetchSegment(ctx context.Context, slug string) (Segments, erro
 	return fetched, nil
 }
 
-func (s *Service) UpdateSegment(ctx context.Context, segment Segments) error {
-	err := s.db.UpdateSegment(ctx, segment)
+func (s *Service) FetchSegmentDetails(ctx context.Context, slug string) (SegmentDetails, error) {
+	fetched, err := s.db.FetchSegmentDetails(ctx, slug)
 	if err != nil {
-		return err
+		return SegmentDetails{}, err
 	}
-	return nil
+	return fetched, nil
+}
+
+// FetchSegments returns page of segments which starts after cursor, zero filter limit means default page size
+func (s *Service) FetchSegments(ctx context.Context, filter SegmentsFilter, cursor string) (SegmentsPage, error) {
+	var details []FieldError
+	filter.Limit = pageLimit(filter.Limit, &details)
+	after, err := DecodeCursor(cursor)
+	if err != nil {
+		return SegmentsPage{}, err
+	}
+	filter.AfterSlug = after.ID
+	if len(details) > 0 {
+		return SegmentsPage{}, &Error{Kind: ErrValidation, Message: "invalid segments filter", Details: details}
+	}
+
+	// one extra segment tells whether there is next page
+	limit := filter.Limit
+	filter.Limit++
+	segments, err := s.db.FetchSegments(ctx, filter)
+	if err != nil {
+		return SegmentsPage{}, err
+	}
+	page := SegmentsPage{Segments: segments}
+	if len(segments) > limit {
+		page.Segments = segments[:limit]
+		page.NextCursor = Cursor{ID: page.Segments[limit-1].Slug}.Encode()
+	}
+	return page, nil
+}
+
+// FetchSegmentMembers returns page of segment members which starts after cursor, zero limit means default page size
+func (s *Service) FetchSegmentMembers(ctx context.Context, slug string, limit int, cursor string) (SegmentMembersPage, error) {
+	var details []FieldError
+	limit = pageLimit(limit, &details)
+	after, err := DecodeCursor(cursor)
+	if err != nil {
+		return SegmentMembersPage{}, err
+	}
+	var afterUserId uuid.UUID
+	if after.ID != "" {
+		afterUserId, err = uuid.Parse(after.ID)
+		if err != nil {
+			details = append(details, FieldError{Field: "cursor", Value: cursor, Message: "malformed cursor"})
+		}
+	}
+	if len(details) > 0 {
+		return SegmentMembersPage{}, &Error{Kind: ErrValidation, Message: "invalid members filter", Details: details}
+	}
+
+	segment, err := s.db.FetchSegment(ctx, slug)
+	if err != nil {
+		return SegmentMembersPage{}, err
+	}
+	// one extra member tells whether there is next page
+	members, err := s.db.FetchSegmentMembers(ctx, segment.ID, afterUserId, limit+1)
+	if err != nil {
+		return SegmentMembersPage{}, err
+	}
+	page := SegmentMembersPage{Members: members}
+	if len(members) > limit {
+		page.Members = members[:limit]
+		page.NextCursor = Cursor{ID: page.Members[limit-1].UserID.String()}.Encode()
+	}
+	return page, nil
 }
 
-func (s *Service) DeleteSegment(ctx context.Context, slug string) error {
-	err := s.db.DeleteSegment(ctx, slug)
+// StreamSegmentMembers passes all active members of segment to fn page by page, so memory usage doesn't depend on segment size.
+// Pages are read by separate queries, members added or removed during streaming may be missed.
+func (s *Service) StreamSegmentMembers(ctx context.Context, slug string, fn func(members []SegmentMember) error) error {
+	segment, err := s.db.FetchSegment(ctx, slug)
 	if err != nil {
 		return err
 	}
-	return nil
+	var afterUserId uuid.UUID
+	for {
+		// request deadline stops streaming between pages
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		members, err := s.db.FetchSegmentMembers(ctx, segment.ID, afterUserId, MaxPageSize)
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 {
+			err = fn(members)
+			if err != nil {
+				return err
+			}
+		}
+		if len(members) < MaxPageSize {
+			return nil
+		}
+		afterUserId = members[len(members)-1].UserID
+	}
+}
+
+func (s *Service) FetchRolloutSegments(ctx context.Context) ([]Segments, error) {
+	segments, err := s.db.FetchRolloutSegments(ctx)
+	if err != nil {
+		return []Segments{}, err
+	}
+	return segments, nil
+}
+
+// UpdateSegment replaces metadata of segment found by slug and renames it if update.Slug differs, empty update.Slug keeps
+// current slug. Previous slug stays resolvable as alias for alias ttl. Rollout settings are not changed.
+func (s *Service) UpdateSegment(ctx context.Context, slug string, update Segments) (Segments, error) {
+	var segment Segments
+	err := s.WithTx(ctx, func(tx *Service) error {
+		var err error
+		segment, err = tx.db.FetchSegment(ctx, slug)
+		if err != nil {
+			return err
+		}
+
+		newSlug := update.Slug
+		if newSlug == "" {
+			newSlug = segment.Slug
+		}
+		if newSlug != segment.Slug {
+			existed, err := tx.db.FetchSegment(ctx, newSlug)
+			if err == nil && existed.ID != segment.ID {
+				return &Error{
+					Kind:    ErrAlreadyExists,
+					Message: fmt.Sprintf("segment %s already exists", newSlug),
+					Details: []FieldError{{Field: "slug", Value: newSlug, Message: "slug is taken by another segment"}},
+				}
+			} else if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+
+			err = tx.db.DeleteSegmentAlias(ctx, newSlug)
+			if err != nil {
+				return err
+			}
+			err = tx.db.SaveSegmentAlias(ctx, SegmentAliases{
+				Slug:      segment.Slug,
+				SegmentID: segment.ID,
+				ExpiresAt: time.Now().Add(tx.aliasTTL),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		segment.Slug = newSlug
+		segment.Description = update.Description
+		segment.Owner = update.Owner
+		segment.Tags = normalizeTags(update.Tags)
+		segment.UpdatedAt = time.Now()
+		return tx.db.UpdateSegment(ctx, segment)
+	})
+	if err != nil {
+		return Segments{}, err
+	}
+	return segment, nil
 }
 
-func (s *Service) CheckExistedUser(ctx context.Context, userId uuid.UUID) bool {
-	res := s.db.CheckExistedUser(ctx, userId)
-	return res
+// ArchiveSegment archives segment found by slug and removes it from all users with history records.
+// Archived segment keeps its slug and history, archiving already archived segment changes nothing.
+func (s *Service) ArchiveSegment(ctx context.Context, slug string) (Segments, error) {
+	var segment Segments
+	err := s.WithTx(ctx, func(tx *Service) error {
+		var err error
+		segment, err = tx.db.FetchSegment(ctx, slug)
+		if err != nil || segment.Archived() {
+			return err
+		}
+
+		currentTime := time.Now()
+		segment.ArchivedAt = &currentTime
+		segment.UpdatedAt = currentTime
+		err = tx.db.UpdateSegment(ctx, segment)
+		if err != nil {
+			return err
+		}
+		return tx.db.RemoveSegmentAssignments(ctx, segment.ID, currentTime, actorFrom(ctx))
+	})
+	if err != nil {
+		return Segments{}, err
+	}
+	return segment, nil
+}
+
+// RestoreSegment makes archived segment assignable again. Previous members are not restored,
+// users are enrolled again only by segment percent.
+func (s *Service) RestoreSegment(ctx context.Context, slug string) (Segments, error) {
+	var segment Segments
+	err := s.WithTx(ctx, func(tx *Service) error {
+		var err error
+		segment, err = tx.db.FetchSegment(ctx, slug)
+		if err != nil {
+			return err
+		}
+		if !segment.Archived() {
+			return NewError(ErrConflict, "segment %s is not archived", segment.Slug)
+		}
+
+		segment.ArchivedAt = nil
+		segment.UpdatedAt = time.Now()
+		err = tx.db.UpdateSegment(ctx, segment)
+		if err != nil {
+			return err
+		}
+		return tx.enrollRollout(ctx, segment)
+	})
+	if err != nil {
+		return Segments{}, err
+	}
+	return segment, nil
+}
+
+// PurgeSegment permanently deletes archived segment with its history, active segment must be archived first
+func (s *Service) PurgeSegment(ctx context.Context, slug string) error {
+	return s.WithTx(ctx, func(tx *Service) error {
+		segment, err := tx.db.FetchSegment(ctx, slug)
+		if err != nil {
+			return err
+		}
+		if !segment.Archived() {
+			return NewError(ErrConflict, "segment %s must be archived before purge", segment.Slug)
+		}
+		return tx.db.DeleteSegment(ctx, segment.Slug)
+	})
+}
+
+func (s *Service) FetchUserIDs(ctx context.Context) ([]uuid.UUID, error) {
+	userIds, err := s.db.FetchUserIDs(ctx)
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	return userIds, nil
+}
+
+func (s *Service) CheckExistedUser(ctx context.Context, userId uuid.UUID) (bool, error) {
+	return s.db.CheckExistedUser(ctx, userId)
+}
+
+// checkUser returns not found error if there is no active user, db errors are returned as is
+func (s *Service) checkUser(ctx context.Context, userId uuid.UUID) error {
+	exists, err := s.db.CheckExistedUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return NewError(ErrNotFound, "user %s not found", userId)
+	}
+	return nil
 }
 
 func (s *Service) AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID, expirationTime time.Time) error {
@@ -156,27 +730,162 @@ func (s *Service) DeleteUserSegments(ctx context.Context, userId, segmentId uuid
 	return nil
 }
 
-func (s *Service) SaveHistory(ctx context.Context, userId, segmentId uuid.UUID, operation string, operatedAt time.Time) error {
-	err := s.db.SaveHistory(ctx, userId, segmentId, operation, operatedAt)
+func (s *Service) SaveHistory(ctx context.Context, entry UserSegmentHistory) error {
+	err := s.db.SaveHistory(ctx, entry)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *Service) GetHistory(ctx context.Context, year, month int) ([]GetHistory, error) {
-	history, err := s.db.GetHistory(ctx, year, month)
+// MonthRange returns bounds of the month in report time zone for HistoryFilter
+func (s *Service) MonthRange(year, month int) (time.Time, time.Time, error) {
+	if month < 1 || month > 12 {
+		return time.Time{}, time.Time{}, NewError(ErrValidation, "month must be in range from 1 to 12, got %d", month)
+	}
+	from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, s.reportLocation)
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// validateHistoryFilter checks report filter
+func validateHistoryFilter(filter HistoryFilter) error {
+	var details []FieldError
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		details = append(details, FieldError{Field: "to", Value: filter.To.Format(time.RFC3339Nano), Message: "must be after from"})
+	}
+	switch filter.Operation {
+	case "", OperationAdd, OperationDelete, OperationExpire:
+	default:
+		details = append(details, FieldError{
+			Field:   "operation",
+			Value:   filter.Operation,
+			Message: fmt.Sprintf("must be %s, %s or %s", OperationAdd, OperationDelete, OperationExpire),
+		})
+	}
+	if len(details) > 0 {
+		return &Error{Kind: ErrValidation, Message: "invalid history filter", Details: details}
+	}
+	return nil
+}
+
+// GetHistory returns history entries for report, zero filter selects whole history
+func (s *Service) GetHistory(ctx context.Context, filter HistoryFilter) ([]GetHistory, error) {
+	err := validateHistoryFilter(filter)
+	if err != nil {
+		return []GetHistory{}, err
+	}
+	history, err := s.db.GetHistory(ctx, filter)
 	if err != nil {
 		return []GetHistory{}, err
 	}
 	return history, nil
 }
 
+// reportBatchSize is number of history entries read at once by StreamHistory
+const reportBatchSize = 1000
+
+// StreamHistory passes history entries for report to fn in batches, so memory usage doesn't depend on report size
+func (s *Service) StreamHistory(ctx context.Context, filter HistoryFilter, fn func(entries []GetHistory) error) error {
+	err := validateHistoryFilter(filter)
+	if err != nil {
+		return err
+	}
+	return s.db.StreamHistory(ctx, filter, reportBatchSize, fn)
+}
+
+// FetchUserSegmentsAt returns segments which active user was in at the instant, including segments archived since then
+func (s *Service) FetchUserSegmentsAt(ctx context.Context, userId uuid.UUID, at time.Time) ([]UserSegment, error) {
+	err := s.checkUser(ctx, userId)
+	if err != nil {
+		return []UserSegment{}, err
+	}
+	segments, err := s.db.FetchUserSegmentsAt(ctx, userId, at)
+	if err != nil {
+		return []UserSegment{}, err
+	}
+	return segments, nil
+}
+
+// FetchUserHistory returns page of events of active user which starts after cursor, zero filter limit means default page size
+func (s *Service) FetchUserHistory(ctx context.Context, userId uuid.UUID, filter UserHistoryFilter, cursor string) (UserHistoryPage, error) {
+	var details []FieldError
+	filter.Limit = pageLimit(filter.Limit, &details)
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		details = append(details, FieldError{Field: "to", Value: filter.To.Format(time.RFC3339Nano), Message: "must be after from"})
+	}
+	after, err := DecodeCursor(cursor)
+	if err != nil {
+		return UserHistoryPage{}, err
+	}
+	if after.ID != "" {
+		filter.AfterID, err = strconv.ParseInt(after.ID, 10, 64)
+		if err == nil {
+			filter.AfterOperationAt, err = time.Parse(time.RFC3339Nano, after.Key)
+		}
+		if err != nil {
+			details = append(details, FieldError{Field: "cursor", Value: cursor, Message: "malformed cursor"})
+		}
+	}
+	if len(details) > 0 {
+		return UserHistoryPage{}, &Error{Kind: ErrValidation, Message: "invalid history filter", Details: details}
+	}
+	err = s.checkUser(ctx, userId)
+	if err != nil {
+		return UserHistoryPage{}, err
+	}
+
+	// one extra event tells whether there is next page
+	limit := filter.Limit
+	filter.Limit++
+	events, err := s.db.FetchUserHistory(ctx, userId, filter)
+	if err != nil {
+		return UserHistoryPage{}, err
+	}
+	for i, event := range events {
+		if event.ExpiresAt != nil {
+			events[i].TTLHours = int(event.ExpiresAt.Sub(event.OperationAt).Round(time.Hour) / time.Hour)
+		}
+	}
+	page := UserHistoryPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		last := page.Events[limit-1]
+		page.NextCursor = Cursor{ID: strconv.FormatInt(last.ID, 10), Key: last.OperationAt.Format(time.RFC3339Nano)}.Encode()
+	}
+	return page, nil
+}
+
+// expireBatchSize limits number of assignments dropped by single statement
+const expireBatchSize = 1000
+
+// DropExpiredSegments drops expired assignments in batches until there is nothing left to drop
 func (s *Service) DropExpiredSegments(ctx context.Context) error {
 	timeNow := time.Now()
-	err := s.db.DropExpiredSegments(ctx, timeNow)
+	for {
+		dropped, err := s.db.DropExpiredSegments(ctx, timeNow, expireBatchSize)
+		if err != nil {
+			return err
+		}
+		if dropped < expireBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *Service) DropExpiredUserSegments(ctx context.Context, userId uuid.UUID) error {
+	timeNow := time.Now()
+	err := s.db.DropExpiredUserSegments(ctx, userId, timeNow)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// NextExpiration returns the closest assignment expiration time, zero time if nothing expires
+func (s *Service) NextExpiration(ctx context.Context) (time.Time, error) {
+	next, err := s.db.NextExpiration(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return next, nil
+}
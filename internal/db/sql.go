@@ -7,11 +7,12 @@ import (
 	"github.com/go-pg/pg/v10"
 	"github.com/go-pg/pg/v10/orm"
 	"github.com/google/uuid"
+	"strings"
 	"time"
 )
 
 type Sql struct {
-	db *pg.DB
+	db orm.DB
 }
 
 func NewSql(db *pg.DB) *Sql {
@@ -20,203 +21,547 @@ func NewSql(db *pg.DB) *Sql {
 	}
 }
 
-func (s *Sql) CreateEnumType(ctx context.Context) error {
-	query := `
-    DO $$ BEGIN
-        IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'operation') THEN
-            CREATE TYPE operation AS ENUM ('добавление', 'удаление');
-        END IF;
-    END $$;
+// RunInTransaction runs fn inside transaction, nested calls reuse already started transaction
+func (s *Sql) RunInTransaction(ctx context.Context, fn func(tx Database) error) error {
+	conn, ok := s.db.(*pg.DB)
+	if !ok {
+		return fn(s)
+	}
+	err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		return fn(&Sql{db: tx})
+	})
+	return translate(err, "transaction")
+}
+
+// expireSegmentsQuery deletes expired assignments and records expiration history for each of them in the same statement.
+// Assignments are claimed with SKIP LOCKED, so concurrent workers never process the same assignment twice.
+const expireSegmentsQuery = `
+    WITH expired AS (
+        DELETE FROM
+            segment_assignments
+        WHERE
+            (user_id, segment_id) IN (
+                SELECT
+                    user_id, segment_id
+                FROM
+                    segment_assignments
+                WHERE
+                    delete_at <= ?
+                %s
+                ORDER BY
+                    delete_at
+                LIMIT ?
+                FOR UPDATE SKIP LOCKED
+            )
+        RETURNING
+            user_id, segment_id, delete_at
+    )
+    INSERT INTO user_segment_history (user_id, segment_id, operation, operation_at, actor)
+    SELECT
+        user_id, segment_id, ?, delete_at, ?
+    FROM
+        expired
 `
-	_, err := s.db.ExecContext(ctx, query)
+
+func (s *Sql) DropExpiredSegments(ctx context.Context, timeNow time.Time, limit int) (int, error) {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(expireSegmentsQuery, ""), timeNow, limit, OperationExpire, ActorSystem)
 	if err != nil {
-		return err
+		return 0, translate(err, "expired segments")
 	}
-	return nil
+	return res.RowsAffected(), nil
 }
 
-func (s *Sql) CreateTable(ctx context.Context, model interface{}) error {
-	err := s.db.ModelContext(ctx, model).CreateTable(&orm.CreateTableOptions{
-		IfNotExists: true,
-		Temp:        false,
-	})
+func (s *Sql) DropExpiredUserSegments(ctx context.Context, userId uuid.UUID, timeNow time.Time) error {
+	query := fmt.Sprintf(expireSegmentsQuery, "AND user_id = ?")
+	// NULL limit means no limit
+	_, err := s.db.ExecContext(ctx, query, timeNow, userId, nil, OperationExpire, ActorSystem)
 	if err != nil {
-		return err
+		return translate(err, "expired user segments")
 	}
 	return nil
 }
 
-func (s *Sql) CreateIndexes(ctx context.Context) error {
+func (s *Sql) NextExpiration(ctx context.Context) (time.Time, error) {
+	var next time.Time
+	_, err := s.db.QueryOneContext(ctx, pg.Scan(&next), "SELECT min(delete_at) FROM segment_assignments")
+	if err != nil {
+		return time.Time{}, translate(err, "next expiration")
+	}
+	return next, nil
+}
+
+// fetchUsersQuery selects page of users first and aggregates segments only for users of that page,
+// so the query cost depends on page size instead of table size
+const fetchUsersQuery = `
+    SELECT
+        u.id as user_id,
+        u.name,
+        u.external_id,
+        coalesce(user_segments.slugs, '{}') as segment_slugs
+    FROM (
+        SELECT
+            id, name, external_id
+        FROM
+            users u
+        WHERE
+            %[1]s
+        ORDER BY
+            %[2]s
+        LIMIT ?
+    ) u
+    LEFT JOIN LATERAL (
+        SELECT
+            array_agg(s.slug ORDER BY s.slug) as slugs
+        FROM
+            segment_assignments sa
+        JOIN
+            segments s ON sa.segment_id = s.id
+        WHERE
+            sa.user_id = u.id
+        AND
+            (sa.delete_at IS NULL OR sa.delete_at > now())
+    ) user_segments ON TRUE
+    ORDER BY
+        %[2]s
+`
+
+// activeAssignmentsQuery selects users with not expired assignments, optionally of single segment
+const activeAssignmentsQuery = `
+    SELECT
+        sa.user_id
+    FROM
+        segment_assignments sa
+    JOIN
+        segments s ON sa.segment_id = s.id
+    WHERE
+        (sa.delete_at IS NULL OR sa.delete_at > now())
+`
 
-	_, err := s.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_user_id ON users (id)")
+// noActiveAssignmentsCondition selects users without not expired assignments as anti-join,
+// unlike NOT IN it isn't affected by NULL user_id of assignments
+const noActiveAssignmentsCondition = `
+    NOT EXISTS (
+        SELECT
+            1
+        FROM
+            segment_assignments sa
+        WHERE
+            sa.user_id = u.id
+        AND
+            (sa.delete_at IS NULL OR sa.delete_at > now())
+    )
+`
+
+func (s *Sql) fetchUsers(ctx context.Context, conditions []string, args []interface{}, order string, limit int) ([]UserWithSegments, error) {
+	// deleted users are kept only for history
+	where := strings.Join(append([]string{"u.deleted_at IS NULL"}, conditions...), " AND ")
+	// NULL limit means no limit
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	args = append(args, limitArg)
+
+	var users []UserWithSegments
+	_, err := s.db.QueryContext(ctx, &users, fmt.Sprintf(fetchUsersQuery, where, order), args...)
 	if err != nil {
-		return err
+		return []UserWithSegments{}, err
 	}
+	return users, nil
+}
 
-	_, err = s.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_segment_id ON segments (id)")
+func (s *Sql) FetchUsers(ctx context.Context, filter UsersFilter) ([]UserWithSegments, error) {
+	var conditions []string
+	var args []interface{}
+	order := "u.id"
+	switch filter.Sort {
+	case UsersSortName:
+		// byte order of names doesn't depend on database locale and matches idx_user_name_id
+		order = `u.name COLLATE "C", u.id`
+		if filter.AfterID != uuid.Nil {
+			conditions = append(conditions, `(u.name COLLATE "C", u.id) > (?, ?)`)
+			args = append(args, filter.AfterName, filter.AfterID)
+		}
+	default:
+		if filter.AfterID != uuid.Nil {
+			conditions = append(conditions, "u.id > ?")
+			args = append(args, filter.AfterID)
+		}
+	}
+	if filter.NamePrefix != "" {
+		conditions = append(conditions, `u.name COLLATE "C" LIKE ?`)
+		args = append(args, likePrefix(filter.NamePrefix))
+	}
+	if filter.SegmentSlug != "" {
+		conditions = append(conditions, "u.id IN ("+activeAssignmentsQuery+" AND s.slug = ?)")
+		args = append(args, filter.SegmentSlug)
+	}
+	if filter.NoSegments {
+		conditions = append(conditions, noActiveAssignmentsCondition)
+	}
+
+	users, err := s.fetchUsers(ctx, conditions, args, order, filter.Limit)
 	if err != nil {
-		return err
+		return []UserWithSegments{}, translate(err, "users")
 	}
+	return users, nil
+}
+
+// likePrefix escapes LIKE wildcards in prefix
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
 
-	_, err = s.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_segment_slug ON segments (slug)")
+func (s *Sql) FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegments, error) {
+	users, err := s.fetchUsers(ctx, []string{"u.id = ?"}, []interface{}{userId}, "u.id", 1)
 	if err != nil {
-		return err
+		return UserWithSegments{}, translate(err, fmt.Sprintf("user %s", userId))
+	}
+	if len(users) == 0 {
+		return UserWithSegments{}, NewError(ErrNotFound, "user %s not found", userId)
 	}
+	return users[0], nil
+}
 
-	_, err = s.db.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS idx_user_segment ON segment_assignments(user_id, segment_id)")
+func (s *Sql) FetchUserByExternalID(ctx context.Context, externalId string) (Users, error) {
+	var user Users
+	err := s.db.ModelContext(ctx, &user).Where("external_id=?", externalId).Where("deleted_at IS NULL").Select()
 	if err != nil {
-		return err
+		return Users{}, translate(err, fmt.Sprintf("user with external id %s", externalId))
 	}
+	return user, nil
+}
 
-	_, err = s.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_delete_at ON segment_assignments (delete_at)")
+func (s *Sql) CreateUser(ctx context.Context, user Users) (Users, error) {
+	_, err := s.db.ModelContext(ctx, &user).Returning("*").Insert()
 	if err != nil {
-		return err
+		return Users{}, translate(err, fmt.Sprintf("user %s", user.ID))
 	}
+	return user, nil
+}
 
-	_, err = s.db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS idx_user_id_history ON user_segment_history (user_id)")
+func (s *Sql) DeleteUser(ctx context.Context, userId uuid.UUID, deletedAt time.Time) error {
+	res, err := s.db.ModelContext(ctx, &Users{}).
+		Set("deleted_at = ?", deletedAt).
+		Where("id=?", userId).
+		Where("deleted_at IS NULL").
+		Update()
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("user %s", userId))
 	}
+	if res.RowsAffected() == 0 {
+		return NewError(ErrNotFound, "user %s not found", userId)
+	}
+	return nil
+}
 
+func (s *Sql) EraseUser(ctx context.Context, userId uuid.UUID) error {
+	// assignments are deleted and history is anonymized by foreign keys
+	res, err := s.db.ModelContext(ctx, &Users{}).Where("id=?", userId).Delete()
+	if err != nil {
+		return translate(err, fmt.Sprintf("user %s", userId))
+	}
+	if res.RowsAffected() == 0 {
+		return NewError(ErrNotFound, "user %s not found", userId)
+	}
 	return nil
 }
 
-func (s *Sql) DropExpiredSegments(ctx context.Context, timeNow time.Time) error {
-	_, err := s.db.ModelContext(ctx, &SegmentAssignments{}).Where("delete_at < ?", timeNow).Delete()
+func (s *Sql) CreateSegment(ctx context.Context, segment Segments) (Segments, error) {
+	_, err := s.db.ModelContext(ctx, &segment).Returning("*").Insert()
+	if err != nil {
+		return Segments{}, translate(err, fmt.Sprintf("segment %s", segment.Slug))
+	}
+	return segment, nil
+}
 
+func (s *Sql) FetchSegment(ctx context.Context, slug string) (Segments, error) {
+	var segment Segments
+	err := s.db.ModelContext(ctx, &segment).Where("slug=?", slug).Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		err = s.db.ModelContext(ctx, &segment).
+			Where("id = (SELECT segment_id FROM segment_aliases WHERE slug = ? AND expires_at > now())", slug).
+			Select()
+	}
 	if err != nil {
-		return err
+		return Segments{}, translate(err, fmt.Sprintf("segment %s", slug))
 	}
-	return nil
+	return segment, nil
 }
 
-func (s *Sql) FetchUsers(ctx context.Context) ([]UserWithSegments, error) {
-	var users []UserWithSegments
-	query := `
+// fetchSegmentsQuery selects page of segments and counts active members only for segments of that page
+const fetchSegmentsQuery = `
     SELECT
-    	u.id as user_id,
-    	array_agg(sa_segments.slug) as segment_slugs
-	FROM
-    	users u
-	LEFT JOIN (
-    	SELECT
-        	sa.user_id,
-        	s.slug
-    	FROM
-        	segment_assignments sa
-    	LEFT JOIN
-        	segments s ON sa.segment_id = s.id
-    	WHERE
-        	s.id IS NOT NULL
-) sa_segments ON u.id = sa_segments.user_id
-	GROUP BY
-    	u.id;
-
+        s.id,
+        s.slug,
+        s.percent,
+        s.description,
+        s.owner,
+        s.tags,
+        s.created_at,
+        s.updated_at,
+        s.archived_at,
+        members.member_count
+    FROM (
+        SELECT
+            id, slug, percent, description, owner, tags, created_at, updated_at, archived_at
+        FROM
+            segments s
+        WHERE
+            %[1]s
+        ORDER BY
+            s.slug COLLATE "C"
+        LIMIT ?
+    ) s
+    LEFT JOIN LATERAL (
+        SELECT
+            count(*) as member_count
+        FROM
+            segment_assignments sa
+        JOIN
+            users u ON sa.user_id = u.id
+        WHERE
+            sa.segment_id = s.id
+        AND
+            (sa.delete_at IS NULL OR sa.delete_at > now())
+    ) members ON TRUE
+    ORDER BY
+        s.slug COLLATE "C"
 `
 
-	_, err := s.db.QueryContext(ctx, &users, query)
+func (s *Sql) fetchSegments(ctx context.Context, conditions []string, args []interface{}, limit int) ([]SegmentDetails, error) {
+	where := "TRUE"
+	if len(conditions) > 0 {
+		where = strings.Join(conditions, " AND ")
+	}
+	// NULL limit means no limit
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	args = append(args, limitArg)
+
+	var segments []SegmentDetails
+	_, err := s.db.QueryContext(ctx, &segments, fmt.Sprintf(fetchSegmentsQuery, where), args...)
 	if err != nil {
-		return []UserWithSegments{}, err
+		return []SegmentDetails{}, err
 	}
-	return users, nil
+	return segments, nil
 }
 
-func (s *Sql) FetchUser(ctx context.Context, userId uuid.UUID) (UserWithSegments, error) {
-	var user UserWithSegments
+func (s *Sql) FetchSegments(ctx context.Context, filter SegmentsFilter) ([]SegmentDetails, error) {
+	conditions := []string{"s.archived_at IS NULL"}
+	if filter.Archived {
+		conditions = []string{"s.archived_at IS NOT NULL"}
+	}
+	var args []interface{}
+	if filter.AfterSlug != "" {
+		conditions = append(conditions, `s.slug COLLATE "C" > ?`)
+		args = append(args, filter.AfterSlug)
+	}
+	if filter.Search != "" {
+		conditions = append(conditions, "s.slug ILIKE ?")
+		args = append(args, "%"+likePrefix(filter.Search))
+	}
+	if filter.Owner != "" {
+		conditions = append(conditions, "s.owner = ?")
+		args = append(args, filter.Owner)
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, "s.tags @> ?")
+		args = append(args, pg.Array([]string{filter.Tag}))
+	}
+
+	segments, err := s.fetchSegments(ctx, conditions, args, filter.Limit)
+	if err != nil {
+		return []SegmentDetails{}, translate(err, "segments")
+	}
+	return segments, nil
+}
+
+func (s *Sql) FetchSegmentDetails(ctx context.Context, slug string) (SegmentDetails, error) {
+	// resolve alias first
+	segment, err := s.FetchSegment(ctx, slug)
+	if err != nil {
+		return SegmentDetails{}, err
+	}
+	segments, err := s.fetchSegments(ctx, []string{"s.id = ?"}, []interface{}{segment.ID}, 1)
+	if err != nil {
+		return SegmentDetails{}, translate(err, fmt.Sprintf("segment %s", slug))
+	}
+	if len(segments) == 0 {
+		return SegmentDetails{}, NewError(ErrNotFound, "segment %s not found", slug)
+	}
+	return segments[0], nil
+}
+
+func (s *Sql) FetchSegmentMembers(ctx context.Context, segmentId, afterUserId uuid.UUID, limit int) ([]SegmentMember, error) {
 	query := `
-	SELECT
-		u.id as user_id,
-		array_agg(sa_segments.slug) as segment_slugs
-	FROM
-		users u
-	LEFT JOIN (
-		SELECT
-			sa.user_id,
-			s.slug
-		FROM
-			segment_assignments sa
-		LEFT JOIN
-			segments s ON sa.segment_id = s.id
-		WHERE
-			s.id IS NOT NULL
-	) sa_segments ON u.id = sa_segments.user_id
-	WHERE u.id = ?
-	GROUP BY
-		u.id;
+    SELECT
+        sa.user_id,
+        u.name,
+        u.external_id,
+        sa.delete_at
+    FROM
+        segment_assignments sa
+    JOIN
+        users u ON sa.user_id = u.id
+    WHERE
+        sa.segment_id = ?
+    AND
+        sa.user_id > ?
+    AND
+        (sa.delete_at IS NULL OR sa.delete_at > now())
+    ORDER BY
+        sa.user_id
+    LIMIT ?
 `
-	_, err := s.db.QueryContext(ctx, &user, query, userId)
+	// NULL limit means no limit
+	var limitArg interface{}
+	if limit > 0 {
+		limitArg = limit
+	}
+	var members []SegmentMember
+	_, err := s.db.QueryContext(ctx, &members, query, segmentId, afterUserId, limitArg)
 	if err != nil {
-		return UserWithSegments{}, err
+		return []SegmentMember{}, translate(err, fmt.Sprintf("segment %s members", segmentId))
 	}
-	return user, nil
+	return members, nil
 }
 
-func (s *Sql) CreateUser(ctx context.Context, name string) error {
-	user := Users{
-		ID:   uuid.New(),
-		Name: name,
+func (s *Sql) FetchRolloutSegments(ctx context.Context) ([]Segments, error) {
+	var segments []Segments
+	err := s.db.ModelContext(ctx, &segments).Where("percent > 0").Where("archived_at IS NULL").Select()
+	if err != nil {
+		return []Segments{}, translate(err, "segments")
 	}
-	_, err := s.db.ModelContext(ctx, &user).Insert()
+	return segments, nil
+}
+
+func (s *Sql) UpdateSegment(ctx context.Context, segment Segments) error {
+	_, err := s.db.ModelContext(ctx, &segment).Column("slug", "description", "owner", "tags", "updated_at", "archived_at").WherePK().Update()
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("segment %s", segment.Slug))
 	}
 	return nil
 }
 
-func (s *Sql) DeleteUser(ctx context.Context, userId uuid.UUID) error {
-	res, err := s.db.ModelContext(ctx, &Users{}).Where("id=?", userId).Delete()
+func (s *Sql) SaveSegmentAlias(ctx context.Context, alias SegmentAliases) error {
+	_, err := s.db.ModelContext(ctx, &alias).
+		OnConflict("(slug) DO UPDATE").
+		Set("segment_id = EXCLUDED.segment_id, expires_at = EXCLUDED.expires_at").
+		Insert()
 	if err != nil {
-		return err
-	}
-	if res.RowsAffected() == 0 {
-		return errors.New(fmt.Sprintf("User with id - %s doesnt't exist", userId))
+		return translate(err, fmt.Sprintf("segment alias %s", alias.Slug))
 	}
 	return nil
 }
 
-func (s *Sql) CreateSegment(ctx context.Context, slug string) error {
-	segment := Segments{
-		ID:   uuid.New(),
-		Slug: slug,
+func (s *Sql) DeleteSegmentAlias(ctx context.Context, slug string) error {
+	_, err := s.db.ModelContext(ctx, &SegmentAliases{}).Where("slug = ?", slug).Delete()
+	if err != nil {
+		return translate(err, fmt.Sprintf("segment alias %s", slug))
 	}
-	_, err := s.db.ModelContext(ctx, &segment).Insert()
+	return nil
+}
+
+// removeAssignmentsQuery deletes all assignments of segment or user and records their removal in history,
+// assignments which already expired but weren't dropped yet are recorded as expired by system at their expiration time
+const removeAssignmentsQuery = `
+    WITH removed AS (
+        DELETE FROM
+            segment_assignments
+        WHERE
+            %s = ?0
+        RETURNING
+            user_id, segment_id, delete_at
+    )
+    INSERT INTO user_segment_history (user_id, segment_id, operation, operation_at, actor)
+    SELECT
+        user_id,
+        segment_id,
+        CASE WHEN delete_at <= ?1 THEN ?2::operation ELSE ?3::operation END,
+        CASE WHEN delete_at <= ?1 THEN delete_at ELSE ?1 END,
+        CASE WHEN delete_at <= ?1 THEN ?4 ELSE ?5 END
+    FROM
+        removed
+`
+
+func (s *Sql) RemoveSegmentAssignments(ctx context.Context, segmentId uuid.UUID, operatedAt time.Time, actor string) error {
+	query := fmt.Sprintf(removeAssignmentsQuery, "segment_id")
+	_, err := s.db.ExecContext(ctx, query, segmentId, operatedAt, OperationExpire, OperationDelete, ActorSystem, actor)
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("segment %s assignments", segmentId))
 	}
 	return nil
 }
 
-func (s *Sql) FetchSegment(ctx context.Context, slug string) (Segments, error) {
-	var segment Segments
-	err := s.db.ModelContext(ctx, &segment).Where("slug=?", slug).Select()
+// enrollRolloutQuery adds segment to all active users of its rollout and records additions in the same statement,
+// rollout_bucket function computes the same bucket as RolloutBucket
+const enrollRolloutQuery = `
+    WITH enrolled AS (
+        INSERT INTO segment_assignments (user_id, segment_id)
+        SELECT
+            id, ?0
+        FROM
+            users
+        WHERE
+            deleted_at IS NULL
+            AND rollout_bucket(id, ?1) < ?2
+        RETURNING
+            user_id, segment_id
+    )
+    INSERT INTO user_segment_history (user_id, segment_id, operation, operation_at, actor)
+    SELECT
+        user_id, segment_id, ?3::operation, ?4, ?5
+    FROM
+        enrolled
+`
+
+func (s *Sql) EnrollRollout(ctx context.Context, segment Segments, operatedAt time.Time, actor string) error {
+	_, err := s.db.ExecContext(ctx, enrollRolloutQuery, segment.ID, segment.Salt, segment.Percent, OperationAdd, operatedAt, actor)
 	if err != nil {
-		return Segments{}, err
+		return translate(err, fmt.Sprintf("segment %s rollout", segment.Slug))
 	}
-	return segment, nil
+	return nil
 }
 
-func (s *Sql) UpdateSegment(ctx context.Context, segment Segments) error {
-	_, err := s.db.ModelContext(ctx, &segment).Update()
+func (s *Sql) RemoveUserAssignments(ctx context.Context, userId uuid.UUID, operatedAt time.Time, actor string) error {
+	query := fmt.Sprintf(removeAssignmentsQuery, "user_id")
+	_, err := s.db.ExecContext(ctx, query, userId, operatedAt, OperationExpire, OperationDelete, ActorSystem, actor)
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("user %s assignments", userId))
 	}
 	return nil
 }
 
 func (s *Sql) DeleteSegment(ctx context.Context, slug string) error {
+	// assignments, aliases and history are deleted by foreign keys
 	res, err := s.db.ModelContext(ctx, &Segments{}).Where("slug=?", slug).Delete()
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("segment %s", slug))
 	}
 	if res.RowsAffected() == 0 {
-		return errors.New(fmt.Sprintf("Segment with slug - %s doesnt't exist", slug))
+		return NewError(ErrNotFound, "segment %s not found", slug)
 	}
 	return nil
 }
 
-func (s *Sql) CheckExistedUser(ctx context.Context, userId uuid.UUID) bool {
-	res, _ := s.db.ModelContext(ctx, &Users{}).Where("id=?", userId).Exists()
-	return res
+func (s *Sql) FetchUserIDs(ctx context.Context) ([]uuid.UUID, error) {
+	var userIds []uuid.UUID
+	err := s.db.ModelContext(ctx, (*Users)(nil)).Column("id").Where("deleted_at IS NULL").Select(&userIds)
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	return userIds, nil
+}
+
+func (s *Sql) CheckExistedUser(ctx context.Context, userId uuid.UUID) (bool, error) {
+	exists, err := s.db.ModelContext(ctx, &Users{}).Where("id=?", userId).Where("deleted_at IS NULL").Exists()
+	if err != nil {
+		return false, translate(err, fmt.Sprintf("user %s", userId))
+	}
+	return exists, nil
 }
 
 func (s *Sql) AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID, expirationTime time.Time) error {
@@ -227,7 +572,7 @@ func (s *Sql) AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID,
 	}
 	_, err := s.db.ModelContext(ctx, &segmentAssignment).Insert()
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("segment %s of user %s", segmentId, userId))
 	}
 	return nil
 }
@@ -235,46 +580,196 @@ func (s *Sql) AddUserSegments(ctx context.Context, userId, segmentId uuid.UUID,
 func (s *Sql) DeleteUserSegments(ctx context.Context, userId, segmentId uuid.UUID) error {
 	_, err := s.db.ExecContext(ctx, "DELETE FROM segment_assignments WHERE user_id = ? AND segment_id = ?", userId, segmentId)
 	if err != nil {
-		return err
+		return translate(err, fmt.Sprintf("segment %s of user %s", segmentId, userId))
 	}
 	return nil
 }
 
-func (s *Sql) SaveHistory(ctx context.Context, userId, segmentId uuid.UUID, operation string, operatedAt time.Time) error {
-	history := UserSegmentHistory{
-		UserID:      userId,
-		SegmentID:   segmentId,
-		Operation:   operation,
-		OperationAt: operatedAt,
-	}
-	_, err := s.db.ModelContext(ctx, &history).Insert()
+func (s *Sql) SaveHistory(ctx context.Context, entry UserSegmentHistory) error {
+	_, err := s.db.ModelContext(ctx, &entry).Insert()
 	if err != nil {
-		return err
+		return translate(err, "history entry")
 	}
 	return nil
 }
 
-func (s *Sql) GetHistory(ctx context.Context, year, month int) ([]GetHistory, error) {
-	var userSegmentsWithSlugs []GetHistory
-	query := `
+// fetchUserSegmentsAtQuery takes the last history entry of each segment of user before the instant,
+// the user was in the segment if that entry is not expired addition
+const fetchUserSegmentsAtQuery = `
     SELECT
-        user_segment_history.user_id,
-        user_segment_history.operation,
-        user_segment_history.operation_at,
-        segments.slug
-    FROM
-        user_segment_history
+        s.slug,
+        last.operation_at as added_at,
+        last.expires_at
+    FROM (
+        SELECT DISTINCT ON (h.segment_id)
+            h.segment_id, h.operation, h.operation_at, h.expires_at
+        FROM
+            user_segment_history h
+        WHERE
+            h.user_id = ?0
+        AND
+            h.operation_at <= ?1
+        ORDER BY
+            h.segment_id, h.operation_at DESC, h.id DESC
+    ) last
     JOIN
-        segments ON user_segment_history.segment_id = segments.id
+        segments s ON last.segment_id = s.id
     WHERE
-        EXTRACT(year FROM user_segment_history.operation_at) = ?
+        last.operation = ?2
     AND
-        EXTRACT(month FROM user_segment_history.operation_at) = ?
+        (last.expires_at IS NULL OR last.expires_at > ?1)
+    ORDER BY
+        s.slug COLLATE "C"
+`
+
+func (s *Sql) FetchUserSegmentsAt(ctx context.Context, userId uuid.UUID, at time.Time) ([]UserSegment, error) {
+	segments := []UserSegment{}
+	_, err := s.db.QueryContext(ctx, &segments, fetchUserSegmentsAtQuery, userId, at, OperationAdd)
+	if err != nil {
+		return []UserSegment{}, translate(err, fmt.Sprintf("segments of user %s", userId))
+	}
+	return segments, nil
+}
+
+// fetchUserHistoryQuery selects page of user history, entries of the user are found by idx_user_id_history
+const fetchUserHistoryQuery = `
+    SELECT
+        h.id,
+        s.slug,
+        h.operation,
+        h.operation_at,
+        h.expires_at,
+        h.actor
+    FROM
+        user_segment_history h
+    JOIN
+        segments s ON h.segment_id = s.id
+    WHERE
+        %s
+    ORDER BY
+        h.operation_at, h.id
+    LIMIT ?
+`
+
+func (s *Sql) FetchUserHistory(ctx context.Context, userId uuid.UUID, filter UserHistoryFilter) ([]HistoryEvent, error) {
+	conditions := []string{"h.user_id = ?"}
+	args := []interface{}{userId}
+	if filter.AfterID != 0 {
+		conditions = append(conditions, "(h.operation_at, h.id) > (?, ?)")
+		args = append(args, filter.AfterOperationAt, filter.AfterID)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "h.operation_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "h.operation_at < ?")
+		args = append(args, filter.To)
+	}
+	if len(filter.SegmentSlugs) > 0 {
+		conditions = append(conditions, "s.slug IN (?)")
+		args = append(args, pg.In(filter.SegmentSlugs))
+	}
+	// NULL limit means no limit
+	var limitArg interface{}
+	if filter.Limit > 0 {
+		limitArg = filter.Limit
+	}
+	args = append(args, limitArg)
+
+	events := []HistoryEvent{}
+	query := fmt.Sprintf(fetchUserHistoryQuery, strings.Join(conditions, " AND "))
+	_, err := s.db.QueryContext(ctx, &events, query, args...)
+	if err != nil {
+		return []HistoryEvent{}, translate(err, fmt.Sprintf("history of user %s", userId))
+	}
+	return events, nil
+}
+
+// getHistoryQuery selects report entries, operation time range is found by idx_operation_at_history
+const getHistoryQuery = `
+    SELECT
+        h.user_id,
+        h.operation,
+        h.operation_at,
+        s.slug,
+        s.description,
+        s.owner,
+        s.tags
+    FROM
+        user_segment_history h
+    JOIN
+        segments s ON h.segment_id = s.id
+    WHERE
+        %s
+    ORDER BY
+        h.operation_at, h.id
 `
-	_, err := s.db.QueryContext(ctx, &userSegmentsWithSlugs, query, year, month)
 
+// historyQuery builds getHistoryQuery for filter
+func historyQuery(filter HistoryFilter) (string, []interface{}) {
+	conditions := []string{"TRUE"}
+	var args []interface{}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "h.operation_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "h.operation_at < ?")
+		args = append(args, filter.To)
+	}
+	if len(filter.SegmentSlugs) > 0 {
+		conditions = append(conditions, "s.slug IN (?)")
+		args = append(args, pg.In(filter.SegmentSlugs))
+	}
+	if len(filter.UserIDs) > 0 {
+		conditions = append(conditions, "h.user_id IN (?)")
+		args = append(args, pg.In(filter.UserIDs))
+	}
+	if filter.Operation != "" {
+		conditions = append(conditions, "h.operation = ?")
+		args = append(args, filter.Operation)
+	}
+	return fmt.Sprintf(getHistoryQuery, strings.Join(conditions, " AND ")), args
+}
+
+func (s *Sql) GetHistory(ctx context.Context, filter HistoryFilter) ([]GetHistory, error) {
+	var userSegmentsWithSlugs []GetHistory
+	query, args := historyQuery(filter)
+	_, err := s.db.QueryContext(ctx, &userSegmentsWithSlugs, query, args...)
 	if err != nil {
-		return []GetHistory{}, err
+		return []GetHistory{}, translate(err, "history")
 	}
 	return userSegmentsWithSlugs, nil
 }
+
+// StreamHistory reads entries by cursor inside single transaction, so all batches see the same snapshot of history
+func (s *Sql) StreamHistory(ctx context.Context, filter HistoryFilter, batchSize int, fn func(entries []GetHistory) error) error {
+	query, args := historyQuery(filter)
+	return s.RunInTransaction(ctx, func(tx Database) error {
+		conn := tx.(*Sql).db
+		_, err := conn.ExecContext(ctx, "DECLARE history_report NO SCROLL CURSOR FOR "+query, args...)
+		if err != nil {
+			return translate(err, "history")
+		}
+		for {
+			var entries []GetHistory
+			_, err = conn.QueryContext(ctx, &entries, "FETCH FORWARD ? FROM history_report", batchSize)
+			if err != nil {
+				return translate(err, "history")
+			}
+			if len(entries) > 0 {
+				err = fn(entries)
+				if err != nil {
+					return err
+				}
+			}
+			if len(entries) < batchSize {
+				break
+			}
+		}
+		// cursor of outer transaction outlives this call
+		_, err = conn.ExecContext(ctx, "CLOSE history_report")
+		return translate(err, "history")
+	})
+}
@@ -0,0 +1,42 @@
+package db_test
+
+import (
+	"context"
+	"github.com/go-pg/pg/v10"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"github.com/nazarovlex/AVITO_TASK/internal/db/dbtest"
+	"os"
+	"testing"
+)
+
+// TestSql runs conformance suite against postgres from TEST_DATABASE_URL, all tables there are truncated
+func TestSql(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	opts, err := pg.ParseURL(url)
+	if err != nil {
+		t.Fatalf("Parse TEST_DATABASE_URL: %v", err)
+	}
+	pgConn := pg.Connect(opts)
+	defer pgConn.Close()
+
+	ctx := context.Background()
+	migrator, err := db.NewMigrator(pgConn)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err)
+	}
+	err = migrator.Up(ctx)
+	if err != nil {
+		t.Fatalf("Migrations up: %v", err)
+	}
+
+	dbtest.Run(t, func(t *testing.T) db.Database {
+		_, err := pgConn.ExecContext(ctx, "TRUNCATE users, segments, segment_aliases, segment_assignments, user_segment_history")
+		if err != nil {
+			t.Fatalf("Truncate tables: %v", err)
+		}
+		return db.NewSql(pgConn)
+	})
+}
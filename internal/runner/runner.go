@@ -7,12 +7,97 @@ import (
 	"time"
 )
 
-func Runner(ctx context.Context, dbService *db2.Service) {
+// electionInterval is how often instances which are not the leader try to take leadership
+const electionInterval = 15 * time.Second
+
+// minWait is the shortest pause between iterations, so assignments which expired but are locked by other
+// transactions don't make the leader query db without pause
+const minWait = time.Second
+
+// Leadership elects single instance among replicas which runs background jobs
+type Leadership interface {
+	TryAcquire(ctx context.Context) (bool, error)
+	Release(ctx context.Context) error
+	Leader(ctx context.Context) (string, error)
+}
+
+// Runner drops expired segments when the closest of them expires, but waits no longer than interval.
+// Only the instance holding leadership does the job. Runner returns when ctx is cancelled.
+func Runner(ctx context.Context, dbService *db2.Service, leadership Leadership, interval time.Duration) {
+	defer func() {
+		err := leadership.Release(context.Background())
+		if err != nil {
+			log.Printf("Runner leadership release error %v\n", err)
+		}
+	}()
+
+	failures := 0
 	for {
-		time.Sleep(1 * time.Hour)
-		err := dbService.DropExpiredSegments(ctx)
+		wait, err := runOnce(ctx, dbService, leadership, interval)
 		if err != nil {
-			log.Printf("Runner error %v\n", err)
+			failures++
+			wait = failureBackoff(failures, interval)
+		} else {
+			failures = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// runOnce runs single iteration of the job and returns time to wait before the next one or error of dropping
+func runOnce(ctx context.Context, dbService *db2.Service, leadership Leadership, interval time.Duration) (time.Duration, error) {
+	leader, err := leadership.TryAcquire(ctx)
+	if err != nil {
+		log.Printf("Runner leader election error %v\n", err)
+	}
+	if !leader {
+		if interval < electionInterval {
+			return interval, nil
 		}
+		return electionInterval, nil
+	}
+
+	err = dbService.DropExpiredSegments(ctx)
+	if err != nil {
+		log.Printf("Runner error %v\n", err)
+		return 0, err
+	}
+	return nextRun(ctx, dbService, interval), nil
+}
+
+// failureBackoff doubles wait after each of consecutive failures starting from minWait, but waits no longer than interval
+func failureBackoff(failures int, interval time.Duration) time.Duration {
+	wait := minWait
+	for i := 1; i < failures && wait < interval; i++ {
+		wait *= 2
+	}
+	if wait > interval {
+		return interval
+	}
+	return wait
+}
+
+func nextRun(ctx context.Context, dbService *db2.Service, interval time.Duration) time.Duration {
+	next, err := dbService.NextExpiration(ctx)
+	if err != nil {
+		log.Printf("Runner error %v\n", err)
+		return interval
+	}
+	if next.IsZero() {
+		return interval
+	}
+	wait := time.Until(next)
+	if wait < minWait {
+		wait = minWait
+	}
+	if wait > interval {
+		return interval
 	}
+	return wait
 }
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/nazarovlex/AVITO_TASK/internal/db"
+	"testing"
+	"time"
+)
+
+func TestNextRun(t *testing.T) {
+	ctx := context.Background()
+	memory := db.NewMemory()
+	dbService := db.NewService(memory)
+
+	if wait := nextRun(ctx, dbService, time.Hour); wait != time.Hour {
+		t.Fatalf("got wait %v without expirations, want interval", wait)
+	}
+
+	userId := createUser(t, memory)
+	err := memory.AddUserSegments(ctx, userId, createSegment(t, memory, "LATER"), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+	if wait := nextRun(ctx, dbService, time.Hour); wait <= 0 || wait > time.Minute {
+		t.Fatalf("got wait %v, want time until next expiration", wait)
+	}
+	if wait := nextRun(ctx, dbService, time.Second); wait != time.Second {
+		t.Fatalf("got wait %v, want interval when expiration is later", wait)
+	}
+
+	err = memory.AddUserSegments(ctx, userId, createSegment(t, memory, "EXPIRED"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+	if wait := nextRun(ctx, dbService, time.Hour); wait != minWait {
+		t.Fatalf("got wait %v for already expired assignment, want %v", wait, minWait)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	for _, test := range []struct {
+		failures int
+		interval time.Duration
+		want     time.Duration
+	}{
+		{1, time.Hour, minWait},
+		{2, time.Hour, 2 * minWait},
+		{4, time.Hour, 8 * minWait},
+		{100, time.Hour, time.Hour},
+		{1, time.Millisecond, time.Millisecond},
+	} {
+		if wait := failureBackoff(test.failures, test.interval); wait != test.want {
+			t.Fatalf("got backoff %v after %d failures with interval %v, want %v", wait, test.failures, test.interval, test.want)
+		}
+	}
+}
+
+func createUser(t *testing.T, memory *db.Memory) uuid.UUID {
+	user, err := memory.CreateUser(context.Background(), db.Users{ID: uuid.New(), Name: "user"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user.ID
+}
+
+func createSegment(t *testing.T, memory *db.Memory, slug string) uuid.UUID {
+	segment, err := memory.CreateSegment(context.Background(), db.Segments{ID: uuid.New(), Slug: slug})
+	if err != nil {
+		t.Fatalf("CreateSegment: %v", err)
+	}
+	return segment.ID
+}
+
+type fakeLeadership struct {
+	leader bool
+}
+
+func (l *fakeLeadership) TryAcquire(ctx context.Context) (bool, error) {
+	return l.leader, nil
+}
+
+func (l *fakeLeadership) Release(ctx context.Context) error {
+	l.leader = false
+	return nil
+}
+
+func (l *fakeLeadership) Leader(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+func TestRunOnceOnlyLeaderDropsExpired(t *testing.T) {
+	ctx := context.Background()
+	memory := db.NewMemory()
+	dbService := db.NewService(memory)
+	err := memory.AddUserSegments(ctx, createUser(t, memory), createSegment(t, memory, "EXPIRED"), time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("AddUserSegments: %v", err)
+	}
+
+	leadership := &fakeLeadership{}
+	if wait, err := runOnce(ctx, dbService, leadership, time.Hour); err != nil || wait != electionInterval {
+		t.Fatalf("got wait %v for follower, want election interval", wait)
+	}
+	if next, _ := memory.NextExpiration(ctx); next.IsZero() {
+		t.Fatal("follower dropped expired assignment")
+	}
+
+	leadership.leader = true
+	if wait, err := runOnce(ctx, dbService, leadership, time.Hour); err != nil || wait != time.Hour {
+		t.Fatalf("got wait %v for leader, want interval", wait)
+	}
+	if next, _ := memory.NextExpiration(ctx); !next.IsZero() {
+		t.Fatal("leader didn't drop expired assignment")
+	}
+}
+
+func TestRunnerStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	leadership := &fakeLeadership{leader: true}
+	done := make(chan struct{})
+	go func() {
+		Runner(ctx, db.NewService(db.NewMemory()), leadership, time.Hour)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runner didn't stop after context cancel")
+	}
+	if leadership.leader {
+		t.Fatal("runner didn't release leadership on stop")
+	}
+}